@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/deckarep/karaoke4go/karaoke"
+)
+
+// autosyncResult is what autosync found for one song.
+type autosyncResult struct {
+	Song      string                `json:"song"`
+	Estimate  *karaoke.SyncEstimate `json:"estimate"`
+	CurrentMs int                   `json:"current_offset_ms"`
+	Applied   bool                  `json:"applied"`
+}
+
+func runAutosync(args []string) error {
+	flags := flag.NewFlagSet("autosync", flag.ExitOnError)
+	apply := flags.Bool("apply", false, "save the estimated offset of every song it is confident about")
+	min_confidence := flags.Float64("min-confidence", 5, "how confident an estimate must be to be applied")
+	as_json := flags.Bool("json", false, "write one JSON object per line instead of text")
+	batch := addBatchFlags(flags)
+	flags.Parse(args)
+
+	files, err := expandInputs(flags.Args(), ".cdg", ".zip")
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("autosync: no .cdg files given")
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+
+	summary, err := runBatch(files, batch,
+		func(file string) (interface{}, error) {
+			song, err := karaoke.LoadSong(file)
+			if err != nil {
+				return nil, err
+			}
+			if !song.HasAudio() {
+				return nil, fmt.Errorf("no audio to sync with")
+			}
+			stream, err := karaoke.OpenAudio(song)
+			if err != nil {
+				return nil, err
+			}
+			estimate, err := karaoke.EstimateSync(song.CDG, stream)
+			if err != nil {
+				return nil, err
+			}
+
+			result := &autosyncResult{Song: song.Name, Estimate: estimate, CurrentMs: song.Meta.OffsetMs}
+			if *apply && estimate.Confidence >= *min_confidence && estimate.OffsetMs != song.Meta.OffsetMs {
+				song.Meta.OffsetMs = estimate.OffsetMs
+				if err := song.SaveMeta(); err != nil {
+					return nil, err
+				}
+				result.Applied = true
+			}
+			return result, nil
+		},
+		func(file string, result interface{}) error {
+			if *as_json {
+				return encoder.Encode(result)
+			}
+			printAutosync(file, result.(*autosyncResult), *min_confidence)
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	if summary.Failed > 0 {
+		return fmt.Errorf("autosync: %d of %d files failed", summary.Failed, len(files))
+	}
+	return nil
+}
+
+func printAutosync(file string, result *autosyncResult, min_confidence float64) {
+	estimate := result.Estimate
+	verdict := "suggested"
+	switch {
+	case result.Applied:
+		verdict = "applied"
+	case estimate.Confidence < min_confidence:
+		verdict = "unsure"
+	case estimate.OffsetMs == result.CurrentMs:
+		verdict = "already set"
+	}
+	fmt.Printf("%s: offset %v, %s (confidence %.1f, currently %dms)\n",
+		file, estimate.Offset(), verdict, estimate.Confidence, result.CurrentMs)
+	fmt.Printf("  %d lyric wipes from %dms, audio from %dms\n", estimate.Wipes, estimate.FirstWipeMs, estimate.LeadingSilenceMs)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// expandInputs turns the files, directories and glob patterns given on the command
+// line into a sorted list of files. Directories are walked recursively for files
+// with one of the extensions, files named explicitly are always kept.
+func expandInputs(args []string, exts ...string) ([]string, error) {
+	seen := make(map[string]bool)
+	files := []string{}
+
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			files = append(files, name)
+		}
+	}
+
+	wanted := func(name string) bool {
+		for _, ext := range exts {
+			if strings.EqualFold(filepath.Ext(name), ext) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var expand func(arg string, explicit bool) error
+	expand = func(arg string, explicit bool) error {
+		if strings.ContainsAny(arg, "*?[") {
+			matches, err := filepath.Glob(arg)
+			if err != nil {
+				return err
+			}
+			if len(matches) == 0 {
+				return fmt.Errorf("%s: no files match", arg)
+			}
+			for _, match := range matches {
+				if err := expand(match, false); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		stat, err := os.Stat(arg)
+		if err != nil {
+			return err
+		}
+		if !stat.IsDir() {
+			if explicit || wanted(arg) {
+				add(arg)
+			}
+			return nil
+		}
+
+		return filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && wanted(path) {
+				add(path)
+			}
+			return nil
+		})
+	}
+
+	for _, arg := range args {
+		if err := expand(arg, true); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// commonDir returns the deepest directory that all files are in, as an
+// absolute path.
+func commonDir(files []string) (string, error) {
+	var common string
+	for idx, file := range files {
+		absolute, err := filepath.Abs(file)
+		if err != nil {
+			return "", err
+		}
+		dir := filepath.Dir(absolute)
+		if idx == 0 {
+			common = dir
+			continue
+		}
+		for !isWithin(common, dir) {
+			common = filepath.Dir(common)
+		}
+	}
+	return common, nil
+}
+
+// isWithin reports whether dir is parent or one of its subdirectories.
+func isWithin(parent, dir string) bool {
+	relative, err := filepath.Rel(parent, dir)
+	return err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
+
+// placeUnder returns where name, beside a song in songs_dir or below it, goes
+// under out_dir: at the same place relative to songs_dir.
+func placeUnder(out_dir, songs_dir, name string) (string, error) {
+	absolute, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	relative, err := filepath.Rel(songs_dir, absolute)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(out_dir, relative), nil
+}
+
+// batchOptions are the flags shared by every command that works on many files.
+type batchOptions struct {
+	jobs     int
+	manifest string
+	quiet    bool
+}
+
+func addBatchFlags(flags *flag.FlagSet) *batchOptions {
+	opts := &batchOptions{}
+	flags.IntVar(&opts.jobs, "j", runtime.NumCPU(), "number of files to process in parallel")
+	flags.StringVar(&opts.manifest, "manifest", "", "append results to this JSON lines file and skip files it already lists as done")
+	flags.BoolVar(&opts.quiet, "q", false, "don't report progress on stderr")
+	return opts
+}
+
+// A batchResult is one line of a results manifest.
+type batchResult struct {
+	File   string      `json:"file"`
+	OK     bool        `json:"ok"`
+	Error  string      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+// batchSummary is what runBatch reports once every file has been processed.
+type batchSummary struct {
+	Total   int
+	OK      int
+	Failed  int
+	Skipped int
+	Elapsed time.Duration
+}
+
+func (s *batchSummary) String() string {
+	return fmt.Sprintf("%d files: %d ok, %d failed, %d skipped in %v",
+		s.Total, s.OK, s.Failed, s.Skipped, s.Elapsed.Round(time.Millisecond))
+}
+
+// loadManifest returns the files a previous run already processed successfully.
+func loadManifest(name string) (map[string]bool, error) {
+	done := make(map[string]bool)
+
+	manifest_file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return done, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer manifest_file.Close()
+
+	scanner := bufio.NewScanner(manifest_file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var result batchResult
+		// A run that was killed may have left half a line behind, just redo that file.
+		if json.Unmarshal(scanner.Bytes(), &result) == nil && result.OK {
+			done[result.File] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+// runBatch calls work for every file on opts.jobs goroutines. emit is called with
+// each successful result, one at a time, from the calling goroutine. Progress
+// goes to stderr and, when opts.manifest is set, every result is appended to the
+// manifest so that an interrupted run can pick up where it left off.
+func runBatch(files []string, opts *batchOptions, work func(file string) (interface{}, error), emit func(file string, result interface{}) error) (*batchSummary, error) {
+	start := time.Now()
+	summary := &batchSummary{Total: len(files)}
+
+	var manifest *json.Encoder
+	if opts.manifest != "" {
+		done, err := loadManifest(opts.manifest)
+		if err != nil {
+			return nil, err
+		}
+		todo := files[:0:0]
+		for _, file := range files {
+			if !done[file] {
+				todo = append(todo, file)
+			}
+		}
+		summary.Skipped = len(files) - len(todo)
+		files = todo
+
+		manifest_file, err := os.OpenFile(opts.manifest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		defer manifest_file.Close()
+		manifest = json.NewEncoder(manifest_file)
+	}
+
+	jobs := opts.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	pending := make(chan string)
+	results := make(chan batchResult)
+	var workers sync.WaitGroup
+
+	for n := 0; n < jobs; n++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for file := range pending {
+				results <- runBatchJob(file, work)
+			}
+		}()
+	}
+
+	go func() {
+		for _, file := range files {
+			pending <- file
+		}
+		close(pending)
+		workers.Wait()
+		close(results)
+	}()
+
+	var emit_err error
+	last_progress := time.Time{}
+	finished := 0
+
+	for result := range results {
+		finished++
+		if result.OK {
+			summary.OK++
+			if emit_err == nil {
+				if !opts.quiet {
+					fmt.Fprint(os.Stderr, "\r\033[K")
+				}
+				emit_err = emit(result.File, result.Result)
+			}
+		} else {
+			summary.Failed++
+			if !opts.quiet {
+				fmt.Fprintf(os.Stderr, "\r\033[K%s: %s\n", result.File, result.Error)
+			}
+		}
+
+		if manifest != nil {
+			if err := manifest.Encode(result); err != nil && emit_err == nil {
+				emit_err = err
+			}
+		}
+
+		if !opts.quiet && (time.Since(last_progress) > 100*time.Millisecond || finished == len(files)) {
+			fmt.Fprintf(os.Stderr, "\r\033[K[%d/%d] %s", finished, len(files), result.File)
+			last_progress = time.Now()
+		}
+	}
+
+	summary.Elapsed = time.Since(start)
+	if !opts.quiet {
+		if finished > 0 {
+			fmt.Fprintln(os.Stderr)
+		}
+		fmt.Fprintln(os.Stderr, summary)
+	}
+	return summary, emit_err
+}
+
+// runBatchJob runs work on one file, turning a panic from damaged data into an
+// error so one bad song doesn't take down a whole library scan.
+func runBatchJob(file string, work func(file string) (interface{}, error)) (result batchResult) {
+	result.File = file
+	defer func() {
+		if r := recover(); r != nil {
+			result.OK = false
+			result.Result = nil
+			result.Error = fmt.Sprintf("panic: %v", r)
+		}
+	}()
+
+	value, err := work(file)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.OK = true
+	result.Result = value
+	return result
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/deckarep/karaoke4go/karaoke"
+)
+
+func runCut(args []string) error {
+	flags := flag.NewFlagSet("cut", flag.ExitOnError)
+	from := positionVar(flags, "from", 0, "start of the clip")
+	to := positionVar(flags, "to", 0, "end of the clip (default: the end of the song)")
+	out_name := flags.String("o", "", "output .cdg file")
+	wav_name := flags.String("wav", "", "output .wav for the audio of the clip (default: next to -o, if the song has audio)")
+	effects := addAudioFlags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || *out_name == "" {
+		return fmt.Errorf("cut: expected one song and -o")
+	}
+	if err := effects.check(); err != nil {
+		return fmt.Errorf("cut: %v", err)
+	}
+
+	song, err := karaoke.LoadSong(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	cdg_file_data := song.CDG
+
+	total_packs := karaoke.Position(len(cdg_file_data) / karaoke.PACK_SIZE)
+	start := from.Position
+	end := total_packs
+	if to.set {
+		end = to.Position
+	}
+	if start >= total_packs {
+		return fmt.Errorf("cut: -from is past the end of the song, which is %v long", total_packs)
+	}
+	if end <= start {
+		return fmt.Errorf("cut: -to must be after -from")
+	}
+
+	clip, preroll := karaoke.Cut(cdg_file_data, start, end)
+	if err := ioutil.WriteFile(*out_name, clip, 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %d packs, the first %d (%v) re-create the screen at %v\n",
+		*out_name, len(clip)/karaoke.PACK_SIZE, preroll, preroll, start)
+
+	// The audio starts as much earlier as the re-created screen takes to play,
+	// which can be before the song does.
+	audio_start := start - preroll
+	if !song.HasAudio() {
+		if audio_start < 0 {
+			fmt.Printf("start the audio from the beginning, %v into the clip, to keep it in sync\n", -audio_start)
+		} else {
+			fmt.Printf("cut the audio from %v (CD address %v) to keep it in sync\n", audio_start, audio_start.MSF())
+		}
+		return nil
+	}
+	if *wav_name == "" {
+		*wav_name = strings.TrimSuffix(*out_name, filepath.Ext(*out_name)) + ".wav"
+	}
+	return cutAudio(song, effects, *wav_name, audio_start, end)
+}
+
+// cutAudio writes the audio of song from start to end to a .wav file, with any
+// effects applied, so it plays in sync with a clip of the graphics. A start
+// before the song is made up with silence.
+func cutAudio(song *karaoke.Song, effects *audioOptions, wav_name string, start, end karaoke.Position) error {
+	stream, err := karaoke.OpenAudio(song)
+	if err != nil {
+		return fmt.Errorf("cut: %v", err)
+	}
+	stream = effects.apply(stream, song)
+	out_file, err := os.Create(wav_name)
+	if err != nil {
+		return err
+	}
+
+	sink := karaoke.NewWAVSink(out_file)
+	rate := stream.SampleRate()
+	err = sink.Open(rate, stream.Channels())
+	var silence int64
+	if start < 0 {
+		silence = karaoke.FramesOfPosition(-start, rate)
+	}
+	if err == nil && silence > 0 {
+		err = sink.Write(make([]float32, silence*int64(stream.Channels())))
+	}
+	if err == nil {
+		from := karaoke.FramesOfPosition(start, rate) + silence
+		err = karaoke.CopyAudio(sink, stream, from, karaoke.FramesOfPosition(end, rate)-from)
+	}
+	if close_err := sink.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		return fmt.Errorf("cut: %s: %v", wav_name, err)
+	}
+
+	if silence > 0 {
+		fmt.Printf("%s: %d sample frames of audio, from %v of silence and then the start of the song\n", wav_name, sink.Frames(), -start)
+	} else {
+		fmt.Printf("%s: %d sample frames of audio from %v\n", wav_name, sink.Frames(), start)
+	}
+	return nil
+}
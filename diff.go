@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/deckarep/karaoke4go/karaoke"
+)
+
+func writePNG(name string, img image.Image) error {
+	out_file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(out_file, img); err != nil {
+		out_file.Close()
+		return err
+	}
+	return out_file.Close()
+}
+
+func runDiff(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	as_json := flags.Bool("json", false, "write the report as JSON")
+	png_mode := flags.String("png", "", "write a PNG at the start of each differing range: side or highlight")
+	out_dir := flags.String("o", ".", "directory for the PNGs written by -png")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		return fmt.Errorf("diff: expected exactly two .cdg files")
+	}
+	if *png_mode != "" && *png_mode != "side" && *png_mode != "highlight" {
+		return fmt.Errorf("diff: unknown -png mode %q, want side or highlight", *png_mode)
+	}
+
+	a_data, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	b_data, err := ioutil.ReadFile(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	var frame func(pack karaoke.Position, a, b *karaoke.Decoder) error
+	if *png_mode != "" {
+		frame = func(pack karaoke.Position, a, b *karaoke.Decoder) error {
+			a_img, b_img := a.RenderScreen(), b.RenderScreen()
+			name := filepath.Join(*out_dir, fmt.Sprintf("diff-%d.png", pack))
+			if *png_mode == "side" {
+				return writePNG(name, karaoke.SideBySide(a_img, b_img))
+			}
+			return writePNG(name, karaoke.HighlightDiff(a_img, b_img))
+		}
+	}
+
+	report, err := karaoke.Diff(a_data, b_data, frame)
+	if err != nil {
+		return err
+	}
+	report.A, report.B = flags.Arg(0), flags.Arg(1)
+
+	if *as_json {
+		if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+			return err
+		}
+	} else {
+		if report.PacksA != report.PacksB {
+			fmt.Printf("length differs: %s has %d packs, %s has %d\n", report.A, report.PacksA, report.B, report.PacksB)
+		}
+		if report.FirstDiff < 0 {
+			fmt.Println("no visible differences")
+		} else {
+			fmt.Printf("first difference at pack %d (%v)\n", report.FirstDiff, report.FirstDiff)
+			for _, r := range report.Ranges {
+				fmt.Printf("  %9v - %9v  packs %d-%d  %s\n", r.StartPack, r.EndPack, r.StartPack, r.EndPack, r.Reason)
+			}
+		}
+	}
+
+	if report.FirstDiff >= 0 {
+		return fmt.Errorf("diff: %d differing ranges", len(report.Ranges))
+	}
+	return nil
+}
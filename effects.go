@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/deckarep/karaoke4go/karaoke"
+)
+
+// audioOptions are the effects play, cut and export apply to a song's audio.
+type audioOptions struct {
+	pitch  *float64
+	vocals *float64 // Negative to use the song's own setting.
+}
+
+func addAudioFlags(flags *flag.FlagSet) *audioOptions {
+	return &audioOptions{
+		pitch:  flags.Float64("pitch", 0, "change the key by this many semitones, -6 to 6"),
+		vocals: flags.Float64("vocals", -1, "take the vocals out of a stereo track, 0 to 1 (default: the song's setting)"),
+	}
+}
+
+func (o *audioOptions) check() error {
+	if *o.pitch < -karaoke.MAX_PITCH_SHIFT || *o.pitch > karaoke.MAX_PITCH_SHIFT {
+		return fmt.Errorf("-pitch must be between -%d and %d semitones", karaoke.MAX_PITCH_SHIFT, karaoke.MAX_PITCH_SHIFT)
+	}
+	if *o.vocals > 1 {
+		return fmt.Errorf("-vocals must be between 0 and 1")
+	}
+	return nil
+}
+
+func checkTempo(tempo float64) error {
+	if tempo < karaoke.MIN_TEMPO || tempo > karaoke.MAX_TEMPO {
+		return fmt.Errorf("-tempo must be between %v and %v", karaoke.MIN_TEMPO, karaoke.MAX_TEMPO)
+	}
+	return nil
+}
+
+// vocalReduction returns how strongly to cancel the vocals of song.
+func (o *audioOptions) vocalReduction(song *karaoke.Song) float64 {
+	if *o.vocals >= 0 {
+		return *o.vocals
+	}
+	return song.Meta.VocalReduction
+}
+
+// shift changes the key of stream, if that was asked for.
+func (o *audioOptions) shift(stream karaoke.AudioStream) karaoke.AudioStream {
+	if *o.pitch != 0 {
+		stream = karaoke.NewPitchShift(stream, *o.pitch)
+	}
+	return stream
+}
+
+// apply wraps the audio of song in the effects that were asked for. The Player
+// reduces vocals itself, so play only needs shift.
+func (o *audioOptions) apply(stream karaoke.AudioStream, song *karaoke.Song) karaoke.AudioStream {
+	return karaoke.NewVocalReduction(o.shift(stream), o.vocalReduction(song))
+}
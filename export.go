@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/deckarep/karaoke4go/karaoke"
+)
+
+// exportResult is what the export command records for each song.
+type exportResult struct {
+	Frames int    `json:"frames"`
+	Dir    string `json:"dir"`
+	Audio  string `json:"audio,omitempty"`
+}
+
+// exportFrames writes a PNG of cdg_file_data every so often into dir, up to the
+// position to, or the whole song if to is 0. At a tempo other than 1 the frames
+// are still every so often in playing time, which covers every*tempo of the song,
+// so a video made from them lines up with audio played at that tempo.
+//
+// The frames can be turned into a video with something like:
+// ffmpeg -framerate 3 -i frame-%d.png -c:v libx264 -r 30 -pix_fmt yuv420p out.mp4
+func exportFrames(cdg_file_data []byte, dir string, to, every karaoke.Position, tempo float64) (int, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	total_packs := karaoke.Position(len(cdg_file_data) / karaoke.PACK_SIZE)
+	if to <= 0 || to > total_packs {
+		to = total_packs
+	}
+
+	decoder := karaoke.NewDecoder()
+	image_count := 0
+
+	for pack := karaoke.Position(0); pack < to; pack = karaoke.Position(float64(image_count) * float64(every) * tempo) {
+		decoder.DecodePacks(cdg_file_data, pack)
+		decoder.RedrawCanvas()
+
+		out_filename := filepath.Join(dir, fmt.Sprintf("frame-%d.png", image_count))
+		if err := writePNG(out_filename, decoder.Image()); err != nil {
+			return image_count, err
+		}
+		image_count++
+	}
+	return image_count, nil
+}
+
+// exportAudio writes the audio of song up to the position to, or all of it if
+// to is 0, to a .wav with the effects applied and at the tempo the frames were
+// spaced for.
+func exportAudio(song *karaoke.Song, effects *audioOptions, tempo float64, to karaoke.Position, wav_name string) error {
+	stream, err := karaoke.OpenAudio(song)
+	if err != nil {
+		return err
+	}
+	stream = karaoke.NewTempo(effects.apply(stream, song), tempo)
+
+	out_file, err := os.Create(wav_name)
+	if err != nil {
+		return err
+	}
+	sink := karaoke.NewWAVSink(out_file)
+	rate := stream.SampleRate()
+	frames := stream.Length()
+	if to > 0 {
+		frames = int64(float64(karaoke.FramesOfPosition(to, rate)) / tempo)
+	}
+	err = sink.Open(rate, stream.Channels())
+	if err == nil {
+		err = karaoke.CopyAudio(sink, stream, 0, frames)
+	}
+	if close_err := sink.Close(); err == nil {
+		err = close_err
+	}
+	return err
+}
+
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	to := positionVar(flags, "to", 0, "stop at this point in the song (default: the whole song)")
+	every := positionVar(flags, "every", 100, "save a PNG this often")
+	tempo := flags.Float64("tempo", 1, "space the frames for playback at this speed, 0.5 to 2")
+	out_dir := flags.String("o", "screenshots", "directory to write one folder of frames per song into")
+	with_audio := flags.Bool("audio", false, "also write the audio, with the effects and tempo, to audio.wav next to the frames")
+	effects := addAudioFlags(flags)
+	batch := addBatchFlags(flags)
+	flags.Parse(args)
+
+	if every.Position < 1 {
+		return fmt.Errorf("export: -every must be at least one pack")
+	}
+	if err := checkTempo(*tempo); err != nil {
+		return fmt.Errorf("export: %v", err)
+	}
+	if err := effects.check(); err != nil {
+		return fmt.Errorf("export: %v", err)
+	}
+
+	inputs := flags.Args()
+	if len(inputs) == 0 {
+		inputs = []string{default_cdg_file}
+	}
+	files, err := expandInputs(inputs, ".cdg", ".zip")
+	if err != nil {
+		return err
+	}
+
+	// Each song's folder keeps its place under the directory all the songs are
+	// in, as thumbnail -d does, so songs with the same name don't share one.
+	songs_dir, err := commonDir(files)
+	if err != nil {
+		return fmt.Errorf("export: %v", err)
+	}
+
+	summary, err := runBatch(files, batch,
+		func(file string) (interface{}, error) {
+			song, err := karaoke.LoadSong(file)
+			if err != nil {
+				return nil, err
+			}
+			dir, err := placeUnder(*out_dir, songs_dir, strings.TrimSuffix(file, filepath.Ext(file)))
+			if err != nil {
+				return nil, err
+			}
+			frames, err := exportFrames(song.CDG, dir, to.Position, every.Position, *tempo)
+			if err != nil {
+				return nil, err
+			}
+			result := &exportResult{Frames: frames, Dir: dir}
+			if *with_audio && song.HasAudio() {
+				result.Audio = filepath.Join(dir, "audio.wav")
+				if err := exportAudio(song, effects, *tempo, to.Position, result.Audio); err != nil {
+					return nil, err
+				}
+			}
+			return result, nil
+		},
+		func(file string, result interface{}) error {
+			export := result.(*exportResult)
+			fmt.Printf("%s: %d frames -> %s\n", file, export.Frames, export.Dir)
+			if export.Audio != "" {
+				fmt.Printf("%s: audio -> %s\n", file, export.Audio)
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	if summary.Failed > 0 {
+		return fmt.Errorf("export: %d of %d files failed", summary.Failed, len(files))
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/deckarep/karaoke4go/karaoke"
+)
+
+// positionFlag is a flag that takes any position karaoke.ParsePosition
+// understands: seconds, mm:ss, a duration, an mm:ss:ff CD address, sector:N or
+// pack:N.
+type positionFlag struct {
+	karaoke.Position
+	set bool // Whether the flag was given on the command line.
+}
+
+func (f *positionFlag) Set(value string) error {
+	position, err := karaoke.ParsePosition(value)
+	if err != nil {
+		return err
+	}
+	f.Position, f.set = position, true
+	return nil
+}
+
+func positionVar(flags *flag.FlagSet, name string, value karaoke.Position, usage string) *positionFlag {
+	f := &positionFlag{Position: value}
+	flags.Var(f, name, usage)
+	return f
+}
@@ -1,19 +1,623 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deckarep/karaoke4go/karaoke"
 )
 
 func main() {
-	// 1.) This handler serves the root page html and .js content
+	addr := flag.String("addr", ":8080", "address to serve on")
+	fps := flag.Int("fps", karaoke.DEFAULT_FRAME_RATE, "frames per second sent to the screens")
+	library_dir := flag.String("library", "./karaoke/", "directory of .cdg, audio and .zip files to index")
+	rotation_file := flag.String("rotation", "rotation.json", "file the singer rotation is kept in")
+	mjpeg_quality := flag.Int("mjpeg-quality", karaoke.MJPEG_QUALITY, "JPEG quality, 1-100, of the /mjpeg stream")
+	audio_out := flag.String("audio", "", "audio output: null, or a .wav file to record to (default: none, the graphics play on the wall clock)")
+	flag.Parse()
+
+	library := karaoke.NewLibrary(*library_dir)
+	scanLibrary(library)
+	rotation, err := karaoke.NewRotation(*rotation_file)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// 1.) The songs given on the command line are decoded here on the server
+	// and sent to the screens as they play, see /frames and /mjpeg below.
+	frames := karaoke.NewTileBroadcaster()
+	mjpeg := karaoke.NewMJPEGBroadcaster(*mjpeg_quality)
+	var player *karaoke.Player
+	if flag.NArg() > 0 {
+		audio, err := openAudioOutput(*audio_out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if player, err = startPlayer(flag.Args(), *fps, audio, frames, mjpeg); err != nil {
+			log.Fatal(err)
+		}
+		if audio != nil {
+			// Finish a .wav recording properly on the way out.
+			interrupt := make(chan os.Signal, 1)
+			signal.Notify(interrupt, os.Interrupt)
+			go func() {
+				<-interrupt
+				player.Stop()
+				audio.Close()
+				os.Exit(1)
+			}()
+		}
+	}
+
+	// 2.) This handler serves the root page html and .js content
 	http.Handle("/", http.FileServer(http.Dir(".")))
 
-	// 2.) This handler serves only the karaoke content
+	// 3.) This handler serves only the karaoke content
 	// To serve a directory on disk (/tmp) under an alternate URL
 	// path (/tmpfiles/), use StripPrefix to modify the request
 	// URL's path before the FileServer sees it:
 	http.Handle("/karaoke/", http.StripPrefix("/karaoke/", http.FileServer(http.Dir("./karaoke/"))))
 
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// 4.) This WebSocket streams the changed tiles of each frame, so screen.html
+	// can show the song without the JS decoder, and keeps the screens' clocks
+	// in step with the server's so they all show each frame at once.
+	http.HandleFunc("/frames", func(w http.ResponseWriter, r *http.Request) {
+		serveFrames(w, r, frames, player)
+	})
+
+	// 5.) This WebSocket is the remote control of remote.html: it takes
+	// commands for the player and sends back what it is playing.
+	http.HandleFunc("/control", func(w http.ResponseWriter, r *http.Request) {
+		serveControl(w, r, player)
+	})
+
+	// 6.) The same frames as an MJPEG stream, for TVs that can open a video
+	// URL but can't run either page.
+	http.HandleFunc("/mjpeg", func(w http.ResponseWriter, r *http.Request) {
+		if allowMethod(w, r, "GET") {
+			serveMJPEG(w, r, mjpeg)
+		}
+	})
+
+	// 7.) The song library, as JSON.
+	http.HandleFunc("/api/songs", func(w http.ResponseWriter, r *http.Request) {
+		if allowMethod(w, r, "GET") {
+			listSongs(w, r, library)
+		}
+	})
+	http.HandleFunc("/api/songs/", func(w http.ResponseWriter, r *http.Request) {
+		if allowMethod(w, r, "GET") {
+			serveSong(w, r, library)
+		}
+	})
+	http.HandleFunc("/api/library/scan", func(w http.ResponseWriter, r *http.Request) {
+		if allowMethod(w, r, "POST") {
+			writeJSON(w, scanLibrary(library))
+		}
+	})
+
+	// 8.) The singer rotation, changed through JSON and watched over a
+	// WebSocket that sends the whole rotation after every change.
+	http.HandleFunc("/api/rotation", func(w http.ResponseWriter, r *http.Request) {
+		serveRotation(w, r, rotation, library)
+	})
+	http.HandleFunc("/api/rotation/", func(w http.ResponseWriter, r *http.Request) {
+		serveRotation(w, r, rotation, library)
+	})
+	http.HandleFunc("/rotation", func(w http.ResponseWriter, r *http.Request) {
+		watchRotation(w, r, rotation)
+	})
+
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+// rotationChange is the body of the requests that change the rotation, each
+// using the fields it needs.
+type rotationChange struct {
+	Name        string   `json:"name"`
+	Present     bool     `json:"present"`
+	SongID      string   `json:"song_id"`
+	Singers     []string `json:"singers"`
+	MaxPerRound int      `json:"max_per_round"`
+}
+
+// serveRotation answers the rotation API:
+//
+//	GET    /api/rotation                        the rotation and who sings next
+//	POST   /api/rotation/singers                {"name"} adds a singer
+//	DELETE /api/rotation/singers/<id>           removes a singer
+//	POST   /api/rotation/singers/<id>/present   {"present"} marks a singer here or not
+//	POST   /api/rotation/singers/<id>/bump      makes a singer next
+//	POST   /api/rotation/singers/<id>/requests  {"song_id"} adds a request
+//	DELETE /api/rotation/requests/<id>          removes a request
+//	PUT    /api/rotation/order                  {"singers"} reorders the rotation
+//	PUT    /api/rotation/settings               {"max_per_round"}
+//	POST   /api/rotation/next                   moves on to the next singer
+func serveRotation(w http.ResponseWriter, r *http.Request, rotation *karaoke.Rotation, library *karaoke.Library) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/rotation"), "/"), "/")
+	var change rotationChange
+	if r.Method == "POST" || r.Method == "PUT" {
+		// A page from another site can POST text/plain or a form here without
+		// asking first, but not application/json, so only that is taken.
+		if media_type, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); media_type != "application/json" {
+			writeError(w, http.StatusUnsupportedMediaType, "expected Content-Type: application/json")
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil && err != io.EOF {
+			writeError(w, http.StatusBadRequest, "bad JSON: "+err.Error())
+			return
+		}
+	}
+
+	var result interface{}
+	var err error
+	route := r.Method + " " + parts[0]
+	switch {
+	case route == "GET " && len(parts) == 1:
+		result = rotation.State()
+	case route == "POST singers" && len(parts) == 1:
+		result, err = rotation.AddSinger(change.Name)
+	case route == "DELETE singers" && len(parts) == 2:
+		err = rotation.RemoveSinger(parts[1])
+	case route == "POST singers" && len(parts) == 3 && parts[2] == "present":
+		err = rotation.SetPresent(parts[1], change.Present)
+	case route == "POST singers" && len(parts) == 3 && parts[2] == "bump":
+		err = rotation.Bump(parts[1])
+	case route == "POST singers" && len(parts) == 3 && parts[2] == "requests":
+		song := library.Song(change.SongID)
+		if song == nil {
+			writeError(w, http.StatusBadRequest, "no such song in the library")
+			return
+		}
+		title := song.Title
+		if song.Artist != "" {
+			title = song.Artist + " - " + song.Title
+		}
+		result, err = rotation.AddRequest(parts[1], song.ID, title)
+	case route == "DELETE requests" && len(parts) == 2:
+		err = rotation.RemoveRequest(parts[1])
+	case route == "PUT order" && len(parts) == 1:
+		err = rotation.Reorder(change.Singers)
+	case route == "PUT settings" && len(parts) == 1:
+		err = rotation.SetMaxPerRound(change.MaxPerRound)
+	case route == "POST next" && len(parts) == 1:
+		result, err = rotation.Advance()
+	default:
+		writeError(w, http.StatusNotFound, "no such rotation request")
+		return
+	}
+
+	switch {
+	case err == karaoke.ErrNotInRotation:
+		writeError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err.Error())
+	case result == nil:
+		writeJSON(w, rotation.State())
+	default:
+		writeJSON(w, result)
+	}
+}
+
+// watchRotation sends the rotation to a WebSocket client as JSON text
+// messages, now and after every change, until it goes away.
+func watchRotation(w http.ResponseWriter, r *http.Request, rotation *karaoke.Rotation) {
+	ws, err := karaoke.UpgradeWebSocket(w, r)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer ws.Close()
+	states, cancel := rotation.Subscribe()
+	defer cancel()
+	gone := readUntilGone(ws)
+
+	for {
+		select {
+		case <-gone:
+			return
+		case state := <-states:
+			message, err := json.Marshal(state)
+			if err == nil {
+				err = ws.WriteMessage(karaoke.WEBSOCKET_TEXT, message)
+			}
+			if err != nil {
+				log.Printf("%s: %v", ws.RemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
+
+// readUntilGone reads and ignores messages from a client that has nothing to
+// say, which is how a close is noticed, and closes the channel it returns once
+// the client has gone.
+func readUntilGone(ws *karaoke.WebSocket) <-chan struct{} {
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	return gone
+}
+
+// scanResult is what POST /api/library/scan answers.
+type scanResult struct {
+	Songs    int      `json:"songs"`
+	Problems []string `json:"problems"`
+}
+
+// scanLibrary rebuilds the index of the library, logging the songs that
+// couldn't be read.
+func scanLibrary(library *karaoke.Library) *scanResult {
+	problems, err := library.Scan()
+	if err != nil {
+		problems = append(problems, err)
+	}
+	result := &scanResult{Songs: len(library.Songs()), Problems: []string{}}
+	for _, problem := range problems {
+		log.Print(problem)
+		result.Problems = append(result.Problems, problem.Error())
+	}
+	log.Printf("%s: %d songs", library.Dir(), result.Songs)
+	return result
+}
+
+// songList is what GET /api/songs answers: a page of the songs matching the
+// search, and how many match in all.
+type songList struct {
+	Total int                    `json:"total"`
+	Songs []*karaoke.LibrarySong `json:"songs"`
+}
+
+// listSongs lists the library, or searches it with the q, artist and title
+// parameters, a page at a time with offset and limit.
+func listSongs(w http.ResponseWriter, r *http.Request, library *karaoke.Library) {
+	query := r.URL.Query()
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil && query.Get("offset") != "" || offset < 0 {
+		writeError(w, http.StatusBadRequest, "bad offset")
+		return
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil && query.Get("limit") != "" || limit < 0 {
+		writeError(w, http.StatusBadRequest, "bad limit")
+		return
+	}
+
+	songs := library.Search(query.Get("q"), query.Get("artist"), query.Get("title"))
+	list := &songList{Total: len(songs)}
+	if offset > len(songs) {
+		offset = len(songs)
+	}
+	songs = songs[offset:]
+	if limit > 0 && limit < len(songs) {
+		songs = songs[:limit]
+	}
+	list.Songs = songs
+	writeJSON(w, list)
+}
+
+// serveSong answers /api/songs/<id> with what the library knows about a song,
+// and /api/songs/<id>/thumbnail.png with its thumbnail, at the size parameter
+// if there is one.
+func serveSong(w http.ResponseWriter, r *http.Request, library *karaoke.Library) {
+	id, rest := r.URL.Path[len("/api/songs/"):], ""
+	if slash := strings.Index(id, "/"); slash >= 0 {
+		id, rest = id[:slash], id[slash:]
+	}
+	song := library.Song(id)
+	if song == nil || rest != "" && rest != "/thumbnail.png" {
+		writeError(w, http.StatusNotFound, "no such song")
+		return
+	}
+	if rest == "" {
+		writeJSON(w, song)
+		return
+	}
+
+	width, height, ok := sizeParam(w, r, 1, 4)
+	if !ok {
+		return
+	}
+	png, err := library.Thumbnail(id, width, height)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(png)
+}
+
+// sizeParam returns the size parameter of the request, the screen scaled by
+// scale if there is none. Sizes over max_scale times the screen answer 400,
+// and ok is false.
+func sizeParam(w http.ResponseWriter, r *http.Request, scale, max_scale int) (width, height int, ok bool) {
+	width, height = scale*karaoke.VISIBLE_WIDTH, scale*karaoke.VISIBLE_HEIGHT
+	if size := r.URL.Query().Get("size"); size != "" {
+		var err error
+		if width, height, err = karaoke.ParseSize(size); err != nil || width > max_scale*karaoke.VISIBLE_WIDTH || height > max_scale*karaoke.VISIBLE_HEIGHT {
+			writeError(w, http.StatusBadRequest, "bad size")
+			return 0, 0, false
+		}
+	}
+	return width, height, true
+}
+
+// allowMethod answers 405 and returns false unless the request is a method
+// request.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, method+" only")
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print(err)
+	}
+}
+
+// writeError answers with status and a JSON {"error": message}.
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// openAudioOutput opens the -audio output, or returns nil if there is none.
+func openAudioOutput(name string) (karaoke.AudioSink, error) {
+	switch {
+	case name == "":
+		return nil, nil
+	case name == "null":
+		return karaoke.NewNullSink(), nil
+	case strings.EqualFold(filepath.Ext(name), ".wav"):
+		out_file, err := os.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		return karaoke.NewWAVSink(out_file), nil
+	}
+	return nil, fmt.Errorf("unknown audio output %q, expected null or a .wav file", name)
+}
+
+// startPlayer plays songs one after another to the sinks. Without an audio
+// output the server plays no audio, on the wall clock, and the screens only
+// show the lyrics.
+func startPlayer(songs []string, fps int, audio karaoke.AudioSink, sinks ...karaoke.FrameSink) (*karaoke.Player, error) {
+	var player *karaoke.Player
+	for _, name := range songs {
+		song, err := karaoke.LoadSong(name)
+		if err != nil {
+			return nil, err
+		}
+		if player != nil {
+			track := karaoke.Track{Name: song.Name, CDG: song.CDG, Offset: song.Meta.Offset()}
+			if audio != nil {
+				track.Audio = songAudio(song)
+			}
+			player.Enqueue(track)
+			continue
+		}
+
+		player = karaoke.NewPlayer(song.CDG, nil)
+		player.SetName(song.Name)
+		player.SetOffset(song.Meta.Offset())
+		if audio != nil {
+			stream := songAudio(song)
+			if stream == nil {
+				stream = karaoke.NewSilence(44100, 2, karaoke.FramesOfPosition(song.Length(), 44100))
+			}
+			if err := player.SetAudio(stream, audio); err != nil {
+				return nil, err
+			}
+		}
+	}
+	player.SetFrameRate(fps)
+	for _, sink := range sinks {
+		player.AddSink(sink)
+	}
+	player.Play()
+	return player, nil
+}
+
+// songAudio opens the audio of song, or returns nil to play silence if it has
+// none or it can't be opened.
+func songAudio(song *karaoke.Song) karaoke.AudioStream {
+	if !song.HasAudio() {
+		return nil
+	}
+	stream, err := karaoke.OpenAudio(song)
+	if err != nil {
+		log.Printf("%v, playing silence instead", err)
+		return nil
+	}
+	return stream
+}
+
+// serveFrames sends the frame messages to one screen until it goes away,
+// answering its clock sync pings and telling it where the song is every
+// karaoke.SYNC_POSITION_INTERVAL. There is no song without a player.
+func serveFrames(w http.ResponseWriter, r *http.Request, frames *karaoke.TileBroadcaster, player *karaoke.Player) {
+	ws, err := karaoke.UpgradeWebSocket(w, r)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer ws.Close()
+	messages, cancel := frames.Subscribe()
+	defer cancel()
+	positions := time.NewTicker(karaoke.SYNC_POSITION_INTERVAL)
+	defer positions.Stop()
+
+	gone := answerPings(ws)
+	err = sendPosition(ws, player)
+	for err == nil {
+		select {
+		case <-gone:
+			return
+		case message := <-messages:
+			err = ws.WriteMessage(karaoke.WEBSOCKET_BINARY, message)
+		case <-positions.C:
+			err = sendPosition(ws, player)
+		}
+	}
+	log.Printf("%s: %v", ws.RemoteAddr(), err)
+}
+
+// answerPings answers the clock sync pings of a screen, and closes the
+// channel it returns once the screen has gone.
+func answerPings(ws *karaoke.WebSocket) <-chan struct{} {
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			opcode, message, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if opcode != karaoke.WEBSOCKET_TEXT {
+				continue
+			}
+			pong, err := karaoke.AnswerPing(message)
+			if err != nil {
+				log.Printf("%s: %v", ws.RemoteAddr(), err)
+				continue
+			}
+			if err := ws.WriteMessage(karaoke.WEBSOCKET_TEXT, pong); err != nil {
+				return
+			}
+		}
+	}()
+	return gone
+}
+
+// sendPosition tells a screen which song is playing and where it is.
+func sendPosition(ws *karaoke.WebSocket, player *karaoke.Player) error {
+	if player == nil {
+		return nil
+	}
+	message, err := json.Marshal(&karaoke.SyncMessage{
+		Type:       "position",
+		ServerTime: karaoke.ServerTime(time.Now()),
+		Song:       player.Current().Name,
+		Position:   player.Position(),
+		Playing:    player.State() == karaoke.PlayerPlaying,
+	})
+	if err != nil {
+		return err
+	}
+	return ws.WriteMessage(karaoke.WEBSOCKET_TEXT, message)
+}
+
+// serveMJPEG streams the frames to one viewer as MJPEG, four times the size of
+// the screen unless the size parameter says otherwise, until it goes away.
+func serveMJPEG(w http.ResponseWriter, r *http.Request, mjpeg *karaoke.MJPEGBroadcaster) {
+	width, height, ok := sizeParam(w, r, 4, 8)
+	if !ok {
+		return
+	}
+	if err := mjpeg.Stream(w, width, height, r.Context().Done()); err != nil {
+		log.Printf("%s: %v", r.RemoteAddr, err)
+	}
+}
+
+// serveControl carries out the commands of a remote control on the player,
+// and sends it the state of the player straight after each command, and every
+// karaoke.REMOTE_STATE_INTERVAL if it has changed, until it goes away.
+func serveControl(w http.ResponseWriter, r *http.Request, player *karaoke.Player) {
+	ws, err := karaoke.UpgradeWebSocket(w, r)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer ws.Close()
+	if player == nil {
+		sendControlError(ws, "nothing to control, the server was started without songs")
+		<-readUntilGone(ws)
+		return
+	}
+	ticker := time.NewTicker(karaoke.REMOTE_STATE_INTERVAL)
+	defer ticker.Stop()
+
+	commanded := make(chan struct{}, 1)
+	gone := readCommands(ws, player, commanded)
+	var sent []byte
+	for {
+		state, err := json.Marshal(karaoke.NewRemoteState(player))
+		if err == nil && !bytes.Equal(state, sent) {
+			err = ws.WriteMessage(karaoke.WEBSOCKET_TEXT, state)
+			sent = state
+		}
+		if err != nil {
+			log.Printf("%s: %v", ws.RemoteAddr(), err)
+			return
+		}
+
+		select {
+		case <-gone:
+			return
+		case <-commanded:
+		case <-ticker.C:
+		}
+	}
+}
+
+// readCommands carries out the commands a remote control sends on player,
+// answering any it can't with an error, and signals commanded after each. It
+// closes the channel it returns once the remote control has gone.
+func readCommands(ws *karaoke.WebSocket, player *karaoke.Player, commanded chan<- struct{}) <-chan struct{} {
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			_, message, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			var command karaoke.RemoteCommand
+			if err := json.Unmarshal(message, &command); err != nil {
+				sendControlError(ws, "bad JSON: "+err.Error())
+				continue
+			}
+			if err := command.Apply(player); err != nil {
+				sendControlError(ws, err.Error())
+				continue
+			}
+			select {
+			case commanded <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return gone
+}
+
+// sendControlError sends a remote control {"type": "error", "error": message}.
+func sendControlError(ws *karaoke.WebSocket, message string) {
+	data, _ := json.Marshal(map[string]string{"type": "error", "error": message})
+	if err := ws.WriteMessage(karaoke.WEBSOCKET_TEXT, data); err != nil {
+		log.Printf("%s: %v", ws.RemoteAddr(), err)
+	}
 }
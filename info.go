@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/deckarep/karaoke4go/karaoke"
+)
+
+func printInfo(info *karaoke.Info) {
+	fmt.Printf("%s: %d packs, %v (%v), %d graphics packs\n", info.File, info.Packs, info.Length, info.Length.MSF(), info.GraphicsPacks)
+	if info.AudioRate != 0 {
+		audio_length := karaoke.PositionOfDuration(time.Duration(info.AudioDuration * float64(time.Second)))
+		fmt.Printf("  audio            %s, %d Hz, %v\n", info.Audio, info.AudioRate, audio_length)
+	} else if info.AudioError != "" {
+		fmt.Printf("  audio            %s\n", info.AudioError)
+	} else {
+		fmt.Printf("  audio            none found\n")
+	}
+
+	names := make([]string, 0, len(info.Instructions))
+	for name := range info.Instructions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %-16s %d\n", name, info.Instructions[name])
+	}
+
+	channels := make([]int, 0, len(info.Channels))
+	for channel := range info.Channels {
+		channels = append(channels, channel)
+	}
+	sort.Ints(channels)
+	for _, channel := range channels {
+		fmt.Printf("  channel %-8d %d font packs\n", channel, info.Channels[channel])
+	}
+}
+
+func runInfo(args []string) error {
+	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	as_json := flags.Bool("json", false, "write one JSON object per line instead of text")
+	batch := addBatchFlags(flags)
+	flags.Parse(args)
+
+	files, err := expandInputs(flags.Args(), ".cdg", ".zip")
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("info: no .cdg files given")
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+
+	summary, err := runBatch(files, batch,
+		func(file string) (interface{}, error) {
+			song, err := karaoke.LoadSong(file)
+			if err != nil {
+				return nil, err
+			}
+			info := karaoke.Inspect(file, song.CDG)
+			info.Audio = song.AudioPath
+			if song.HasAudio() {
+				if stream, err := karaoke.OpenAudio(song); err != nil {
+					info.AudioError = err.Error()
+				} else {
+					info.AudioRate = stream.SampleRate()
+					info.AudioDuration = float64(stream.Length()) / float64(stream.SampleRate())
+				}
+			}
+			return info, nil
+		},
+		func(file string, result interface{}) error {
+			if *as_json {
+				return encoder.Encode(result)
+			}
+			printInfo(result.(*karaoke.Info))
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	if summary.Failed > 0 {
+		return fmt.Errorf("info: %d of %d files failed", summary.Failed, len(files))
+	}
+	return nil
+}
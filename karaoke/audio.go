@@ -0,0 +1,216 @@
+package karaoke
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// An AudioStream is decoded audio: interleaved float32 samples between -1 and 1,
+// Channels of them per sample frame. Every audio format is decoded behind this
+// interface, and the effects wrap one stream in another.
+type AudioStream interface {
+	SampleRate() int
+	Channels() int
+
+	// Read fills samples with whole sample frames and returns how many samples
+	// it wrote. It returns io.EOF at the end of the stream.
+	Read(samples []float32) (int, error)
+
+	// SeekFrame moves to a sample frame counted from the start of the stream.
+	SeekFrame(frame int64) error
+
+	// Length returns the length of the stream in sample frames, or -1 if it is
+	// not known without decoding the whole stream.
+	Length() int64
+}
+
+// OpenAudio returns a stream decoding the audio of song.
+func OpenAudio(song *Song) (AudioStream, error) {
+	if !song.HasAudio() {
+		return nil, fmt.Errorf("%s: the song has no audio", song.Name)
+	}
+	switch song.AudioFormat {
+	case "mp3":
+		return NewMP3Stream(song.Audio)
+	case "ogg":
+		return NewVorbisStream(song.Audio)
+	case "wav":
+		return NewWAVStream(song.Audio)
+	}
+	return nil, fmt.Errorf("%s: can't decode %s audio", song.AudioPath, song.AudioFormat)
+}
+
+// silence is an AudioStream of nothing but zeros.
+type silence struct {
+	rate     int
+	channels int
+	length   int64
+	frame    int64
+}
+
+// NewSilence returns length sample frames of silence, for playing the graphics of
+// a song that has no audio through the same path as one that has.
+func NewSilence(rate, channels int, length int64) AudioStream {
+	return &silence{rate: rate, channels: channels, length: length}
+}
+
+func (s *silence) SampleRate() int { return s.rate }
+func (s *silence) Channels() int   { return s.channels }
+func (s *silence) Length() int64   { return s.length }
+
+func (s *silence) Read(samples []float32) (int, error) {
+	frames := int64(len(samples) / s.channels)
+	if left := s.length - s.frame; frames > left {
+		frames = left
+	}
+	if frames <= 0 {
+		return 0, io.EOF
+	}
+	n := int(frames) * s.channels
+	for i := range samples[:n] {
+		samples[i] = 0
+	}
+	s.frame += frames
+	return n, nil
+}
+
+func (s *silence) SeekFrame(frame int64) error {
+	if frame < 0 {
+		frame = 0
+	}
+	s.frame = frame
+	return nil
+}
+
+// CopyAudio writes frames sample frames of stream, starting at sample frame from,
+// to sink, which must already be open. Past the end of the stream it writes
+// silence, so the audio always lasts as long as was asked for.
+func CopyAudio(sink AudioSink, stream AudioStream, from, frames int64) error {
+	if err := stream.SeekFrame(from); err != nil {
+		return err
+	}
+	channels := stream.Channels()
+	buf := make([]float32, 4096*channels)
+	for frames > 0 {
+		if left := frames * int64(channels); int64(len(buf)) > left {
+			buf = buf[:left]
+		}
+		n, err := stream.Read(buf)
+		if err == io.EOF {
+			for i := n; i < len(buf); i++ {
+				buf[i] = 0
+			}
+			n, err = len(buf), nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := sink.Write(buf[:n]); err != nil {
+			return err
+		}
+		frames -= int64(n / channels)
+	}
+	return nil
+}
+
+// FramesOfPosition converts a position in the graphics to a sample frame at rate.
+func FramesOfPosition(position Position, rate int) int64 {
+	return int64(position) * int64(rate) / PACKS_PER_SECOND
+}
+
+// remixed maps the channels of a stream onto another number of channels: mono
+// is copied to every channel, anything else down to mono is averaged, and
+// otherwise channels are dropped or left silent.
+type remixed struct {
+	AudioStream
+	channels int
+	buf      []float32
+}
+
+func (r *remixed) Channels() int { return r.channels }
+
+func (r *remixed) Read(samples []float32) (int, error) {
+	in_channels := r.AudioStream.Channels()
+	frames := len(samples) / r.channels
+	if cap(r.buf) < frames*in_channels {
+		r.buf = make([]float32, frames*in_channels)
+	}
+	n, err := r.AudioStream.Read(r.buf[:frames*in_channels])
+	frames = n / in_channels
+	for frame := 0; frame < frames; frame++ {
+		in := r.buf[frame*in_channels : (frame+1)*in_channels]
+		out := samples[frame*r.channels : (frame+1)*r.channels]
+		switch {
+		case in_channels == 1:
+			for c := range out {
+				out[c] = in[0]
+			}
+		case r.channels == 1:
+			var sum float32
+			for _, value := range in {
+				sum += value
+			}
+			out[0] = sum / float32(in_channels)
+		default:
+			for c := range out {
+				out[c] = 0
+				if c < in_channels {
+					out[c] = in[c]
+				}
+			}
+		}
+	}
+	return frames * r.channels, err
+}
+
+// resampled reports the rate a resampler converts to.
+type resampled struct {
+	*resampler
+	rate int
+}
+
+func (r *resampled) SampleRate() int { return r.rate }
+
+// NewConversion returns source converted to rate and channels, so songs of
+// different formats can be played one after another on the same sink.
+func NewConversion(source AudioStream, rate, channels int) AudioStream {
+	if source.Channels() != channels {
+		source = &remixed{AudioStream: source, channels: channels}
+	}
+	if source.SampleRate() != rate {
+		source = &resampled{newResampler(source, float64(source.SampleRate())/float64(rate)), rate}
+	}
+	return source
+}
+
+// looped plays a stream over and over, for break music.
+type looped struct {
+	AudioStream
+}
+
+func (l *looped) Length() int64 { return -1 }
+
+func (l *looped) Read(samples []float32) (int, error) {
+	n, err := l.AudioStream.Read(samples)
+	if err == io.EOF && n == 0 {
+		if err := l.AudioStream.SeekFrame(0); err != nil {
+			return 0, err
+		}
+		return l.AudioStream.Read(samples)
+	}
+	return n, err
+}
+
+// OpenAudioFile returns a stream decoding an .mp3, .ogg or .wav file that
+// isn't part of a song, such as break music.
+func OpenAudioFile(name string) (AudioStream, error) {
+	if !isAudioFile(name) {
+		return nil, fmt.Errorf("%s: not an .mp3, .ogg or .wav file", name)
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return OpenAudio(&Song{Name: baseName(name), AudioPath: name, AudioFormat: audioFormat(name), Audio: data})
+}
@@ -0,0 +1,209 @@
+package karaoke
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	SYNC_MAX_OFFSET = 2 * time.Second // How far out of sync EstimateSync looks either way.
+	SYNC_WIPES      = 48              // How many lyric wipes EstimateSync lines up with the audio.
+
+	sync_hop        = 10 * time.Millisecond // The resolution of the audio envelope.
+	sync_draw_run   = 24                    // XOR_FONT packs in a row beyond which they are drawing text, not wiping it.
+	sync_run_gap    = 4                     // Packs between two XOR_FONT packs of the same run.
+	sync_wipe_gap   = 45                    // Packs of quiet before a wipe counts as a new syllable.
+	sync_silence_db = -50                   // Level below which the start of the audio counts as silent.
+)
+
+// A SyncEstimate is EstimateSync's guess at how far a song's graphics are out of
+// sync with its audio.
+type SyncEstimate struct {
+	OffsetMs         int     `json:"offset_ms"`  // The offset for SongMeta that would line them up.
+	Confidence       float64 `json:"confidence"` // How far the best match stands out from the rest, in standard deviations.
+	Wipes            int     `json:"wipes"`      // Lyric wipes that were matched against the audio.
+	FirstWipeMs      int     `json:"first_wipe_ms"`
+	LeadingSilenceMs int     `json:"leading_silence_ms"`
+}
+
+// Offset is the estimated offset of the graphics.
+func (e *SyncEstimate) Offset() time.Duration {
+	return time.Duration(e.OffsetMs) * time.Millisecond
+}
+
+// LyricWipes returns where the syllables of the lyrics start being wiped. Text
+// is drawn onto the screen, the title card included, in long unbroken runs of
+// font packs, and then highlighted a syllable at a time by short runs of
+// XOR_FONT packs as it is sung. The returned positions are the starts of the
+// short runs that follow a pause, which is when a singer starts a syllable.
+func LyricWipes(cdg_file_data []byte) []Position {
+	var wipes []Position
+	run_start, run_end, last_wipe := -1, -1, -sync_wipe_gap-1
+
+	end_run := func() {
+		if run_start < 0 {
+			return
+		}
+		if run_end-run_start < sync_draw_run {
+			if run_start-last_wipe > sync_wipe_gap {
+				wipes = append(wipes, Position(run_start))
+			}
+			last_wipe = run_end
+		}
+		run_start = -1
+	}
+
+	packs := len(cdg_file_data) / PACK_SIZE
+	for curr_pack := 0; curr_pack < packs; curr_pack++ {
+		this_pack := cdg_file_data[curr_pack*PACK_SIZE : (curr_pack+1)*PACK_SIZE]
+		if this_pack[0]&0x3F != TV_GRAPHICS || this_pack[1]&0x3F != XOR_FONT {
+			continue
+		}
+		if curr_pack-run_end > sync_run_gap {
+			end_run()
+			run_start = curr_pack
+		}
+		run_end = curr_pack
+	}
+	end_run()
+	return wipes
+}
+
+// audioEnvelope reads up to length of stream from the start and returns the
+// onset strength of every sync_hop, how sharply the level rose in the band where
+// voices are, and how long the audio is silent before anything is heard.
+func audioEnvelope(stream AudioStream, length time.Duration) (onsets []float64, leading_silence time.Duration, err error) {
+	if err := stream.SeekFrame(0); err != nil {
+		return nil, 0, err
+	}
+	rate, channels := stream.SampleRate(), stream.Channels()
+	hop := int(sync_hop * time.Duration(rate) / time.Second)
+	hops := int(length / sync_hop)
+
+	// One pole high and low pass filters, leaving roughly 200 Hz to 4 kHz.
+	high_pass := math.Exp(-2 * math.Pi * 200 / float64(rate))
+	low_pass := 1 - math.Exp(-2*math.Pi*4000/float64(rate))
+	var last_in, high, low float64
+
+	silence := math.Pow(10, sync_silence_db/10.0)
+	heard := false
+	last_level := math.Log(silence)
+	var band_energy, energy float64
+	in_hop := 0
+
+	buf := make([]float32, 4096*channels)
+	for len(onsets) < hops {
+		n, err := stream.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for frame := 0; frame+channels <= n; frame += channels {
+			var mono float64
+			for _, value := range buf[frame : frame+channels] {
+				mono += float64(value)
+			}
+			mono /= float64(channels)
+
+			high = high_pass * (high + mono - last_in)
+			last_in = mono
+			low += low_pass * (high - low)
+			band_energy += low * low
+			energy += mono * mono
+
+			if in_hop++; in_hop < hop {
+				continue
+			}
+			if !heard && energy/float64(hop) > silence {
+				heard = true
+				leading_silence = time.Duration(len(onsets)) * sync_hop
+			}
+			level := math.Log(band_energy/float64(hop) + silence)
+			onsets = append(onsets, math.Max(0, level-last_level))
+			last_level = level
+			band_energy, energy, in_hop = 0, 0, 0
+		}
+	}
+	if !heard {
+		leading_silence = time.Duration(len(onsets)) * sync_hop
+	}
+	return onsets, leading_silence, nil
+}
+
+// EstimateSync works out how far the graphics of a song are out of sync with
+// its audio, by lining up the first SYNC_WIPES lyric wipes with the onsets in
+// the audio: every offset up to SYNC_MAX_OFFSET either way is scored by how
+// strong the onsets are where it would put the wipes, and the offset scoring
+// best wins. Offsets that would start the lyrics before the audio has left its
+// leading silence are ruled out. Noise alone makes the best of the 400 or so
+// offsets stand about 3 deviations out, so a confidence below 5 means the audio
+// gave no clear answer, as happens with busy mixes that bury the vocals.
+func EstimateSync(cdg_file_data []byte, stream AudioStream) (*SyncEstimate, error) {
+	wipes := LyricWipes(cdg_file_data)
+	if len(wipes) == 0 {
+		return nil, fmt.Errorf("no lyric wipes found in the graphics")
+	}
+	if len(wipes) > SYNC_WIPES {
+		wipes = wipes[:SYNC_WIPES]
+	}
+
+	onsets, leading_silence, err := audioEnvelope(stream, wipes[len(wipes)-1].Duration()+SYNC_MAX_OFFSET+time.Second)
+	if err != nil {
+		return nil, err
+	}
+	estimate := &SyncEstimate{
+		Wipes:            len(wipes),
+		FirstWipeMs:      int(wipes[0].Duration() / time.Millisecond),
+		LeadingSilenceMs: int(leading_silence / time.Millisecond),
+	}
+
+	// Score each offset by the mean onset strength at the wipes, taking the
+	// stronger of the hop at each and the one before to allow for rounding.
+	max_lag := int(SYNC_MAX_OFFSET / sync_hop)
+	first_lag := int((leading_silence - wipes[0].Duration()) / sync_hop)
+	var lags []int
+	var scores []float64
+	for lag := -max_lag; lag <= max_lag; lag++ {
+		if lag < first_lag {
+			continue
+		}
+		var score float64
+		for _, wipe := range wipes {
+			at := int(wipe.Duration()/sync_hop) + lag
+			var strongest float64
+			for _, hop := range []int{at - 1, at} {
+				if hop >= 0 && hop < len(onsets) {
+					strongest = math.Max(strongest, onsets[hop])
+				}
+			}
+			score += strongest
+		}
+		lags, scores = append(lags, lag), append(scores, score/float64(len(wipes)))
+	}
+	if len(scores) < 2 {
+		return nil, fmt.Errorf("the audio is silent where the lyrics are")
+	}
+
+	best, mean := 0, 0.0
+	for i, score := range scores {
+		if score > scores[best] {
+			best = i
+		}
+		mean += score
+	}
+	mean /= float64(len(scores))
+	var variance float64
+	for _, score := range scores {
+		variance += (score - mean) * (score - mean)
+	}
+	if deviation := math.Sqrt(variance / float64(len(scores))); deviation > 0 {
+		estimate.Confidence = math.Round((scores[best]-mean)/deviation*10) / 10
+	}
+	estimate.OffsetMs = int(time.Duration(lags[best]) * sync_hop / time.Millisecond)
+	return estimate, nil
+}
@@ -0,0 +1,113 @@
+package karaoke
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock tells a Player how much of the song has played. The Player starts,
+// pauses and seeks the clock along with itself; everything else about how time
+// passes is up to the clock. All methods may be called from any goroutine.
+type Clock interface {
+	Elapsed() time.Duration
+	Start()
+	Pause()
+	Seek(to time.Duration)
+}
+
+// A WallClock follows real time, for playing graphics without any audio.
+type WallClock struct {
+	mu      sync.Mutex
+	elapsed time.Duration // Time played up to the last Start, Pause or Seek.
+	started time.Time     // When the clock was last started, zero while paused.
+}
+
+// NewWallClock returns a paused WallClock at the start of the song.
+func NewWallClock() *WallClock {
+	return &WallClock{}
+}
+
+func (c *WallClock) Elapsed() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.started.IsZero() {
+		return c.elapsed
+	}
+	return c.elapsed + time.Since(c.started)
+}
+
+func (c *WallClock) Start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.started.IsZero() {
+		c.started = time.Now()
+	}
+}
+
+func (c *WallClock) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.started.IsZero() {
+		c.elapsed += time.Since(c.started)
+		c.started = time.Time{}
+	}
+}
+
+func (c *WallClock) Seek(to time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.elapsed = to
+	if !c.started.IsZero() {
+		c.started = time.Now()
+	}
+}
+
+// A SampleClock counts the audio samples that have been played, so the graphics
+// follow the audio exactly, however fast or unevenly it is consumed. Whatever
+// plays the audio calls Advance after each buffer; Start and Pause do nothing
+// because the clock only moves when samples do.
+type SampleClock struct {
+	mu      sync.Mutex
+	rate    int   // Sample frames per second.
+	samples int64 // Sample frames played since the start of the song.
+}
+
+// NewSampleClock returns a SampleClock for audio at rate sample frames per second.
+func NewSampleClock(rate int) *SampleClock {
+	return &SampleClock{rate: rate}
+}
+
+// Advance records that frames more sample frames have been played.
+func (c *SampleClock) Advance(frames int) {
+	c.mu.Lock()
+	c.samples += int64(frames)
+	c.mu.Unlock()
+}
+
+// Samples returns the number of sample frames played since the start of the song.
+func (c *SampleClock) Samples() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.samples
+}
+
+// Rate returns the sample rate the clock counts in.
+func (c *SampleClock) Rate() int {
+	return c.rate
+}
+
+func (c *SampleClock) Elapsed() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Duration(c.samples) * time.Second / time.Duration(c.rate)
+}
+
+func (c *SampleClock) Start() {}
+
+func (c *SampleClock) Pause() {}
+
+func (c *SampleClock) Seek(to time.Duration) {
+	c.mu.Lock()
+	c.samples = int64(to) * int64(c.rate) / int64(time.Second)
+	c.mu.Unlock()
+}
@@ -0,0 +1,182 @@
+package karaoke
+
+// newPack returns a TV graphics pack carrying instruction. The caller fills in
+// the data symbols and then calls setPackParity.
+func newPack(instruction byte) []byte {
+	cdg_pack := make([]byte, PACK_SIZE)
+	cdg_pack[0] = TV_GRAPHICS
+	cdg_pack[1] = instruction
+	return cdg_pack
+}
+
+// clutPack encodes eight palette entries, the inverse of proc_LOAD_CLUT.
+func clutPack(instruction byte, colors []int) []byte {
+	cdg_pack := newPack(instruction)
+	for pal_inc, rgb := range colors {
+		red := ((rgb >> 020) & 0xFF) / 17
+		green := ((rgb >> 010) & 0xFF) / 17
+		blue := ((rgb >> 000) & 0xFF) / 17
+		cdg_pack[pal_inc*2+4] = byte((red << 2) | (green >> 2))
+		cdg_pack[pal_inc*2+5] = byte(((green & 0x03) << 4) | blue)
+	}
+	setPackParity(cdg_pack)
+	return cdg_pack
+}
+
+// tilePixels unpacks the 6x12 pixel indices of the font block at x_blk, y_blk.
+func (d *Decoder) tilePixels(x_blk, y_blk int) (pixels [FONT_HEIGHT][FONT_WIDTH]int) {
+	start_pixel := y_blk*NUM_X_FONTS*FONT_HEIGHT + x_blk
+	for y_inc := 0; y_inc < FONT_HEIGHT; y_inc++ {
+		curr_line_indices := d.vram[start_pixel+y_inc*NUM_X_FONTS]
+		for pxl := 0; pxl < FONT_WIDTH; pxl++ {
+			pixels[y_inc][pxl] = (curr_line_indices >> uint(pxl*4)) & 0x0F
+		}
+	}
+	return pixels
+}
+
+// fontPacks returns the packs that draw pixels into the font block at x_blk,
+// y_blk: a COPY_FONT with the two most common colors, then one XOR_FONT for each
+// further color, flipping its pixels from the background to the wanted index.
+func fontPacks(x_blk, y_blk int, pixels [FONT_HEIGHT][FONT_WIDTH]int) [][]byte {
+	var counts [PALETTE_ENTRIES]int
+	for _, row := range pixels {
+		for _, index := range row {
+			counts[index]++
+		}
+	}
+
+	// Order the colors used, most common first.
+	colors := []int{}
+	for index, count := range counts {
+		if count > 0 {
+			colors = append(colors, index)
+		}
+	}
+	for i := 1; i < len(colors); i++ {
+		for j := i; j > 0 && counts[colors[j]] > counts[colors[j-1]]; j-- {
+			colors[j], colors[j-1] = colors[j-1], colors[j]
+		}
+	}
+
+	background := colors[0]
+	font_pack := func(instruction byte, color0, color1, match int) []byte {
+		cdg_pack := newPack(instruction)
+		cdg_pack[4] = byte(color0)
+		cdg_pack[5] = byte(color1)
+		cdg_pack[6] = byte(y_blk)
+		cdg_pack[7] = byte(x_blk)
+		for y_inc, row := range pixels {
+			for pxl, index := range row {
+				if index == match {
+					cdg_pack[y_inc+8] |= 0x20 >> uint(pxl)
+				}
+			}
+		}
+		setPackParity(cdg_pack)
+		return cdg_pack
+	}
+
+	if len(colors) == 1 {
+		return [][]byte{font_pack(COPY_FONT, background, background, -1)}
+	}
+
+	packs := [][]byte{font_pack(COPY_FONT, background, colors[1], colors[1])}
+	for _, index := range colors[2:] {
+		packs = append(packs, font_pack(XOR_FONT, 0, background^index, index))
+	}
+	return packs
+}
+
+// StatePacks returns a stream of packs that takes a freshly reset decoder to the
+// state d is in now: the color table, a MEMORY_PRESET to the most common color,
+// a redraw of every font block the preset didn't already get right, the border
+// and the scroll offsets.
+func (d *Decoder) StatePacks() []byte {
+	stream := []byte{}
+
+	stream = append(stream, clutPack(LOAD_CLUT_LO, d.palette[0:8])...)
+	stream = append(stream, clutPack(LOAD_CLUT_HI, d.palette[8:16])...)
+
+	var counts [PALETTE_ENTRIES]int
+	for _, curr_line_indices := range d.vram {
+		for pxl := uint(0); pxl < FONT_WIDTH; pxl++ {
+			counts[(curr_line_indices>>(pxl*4))&0x0F]++
+		}
+	}
+	preset_color := 0
+	for index, count := range counts {
+		if count > counts[preset_color] {
+			preset_color = index
+		}
+	}
+
+	preset_pack := newPack(MEMORY_PRESET)
+	preset_pack[4] = byte(preset_color)
+	setPackParity(preset_pack)
+	stream = append(stream, preset_pack...)
+
+	for y_blk := 0; y_blk < NUM_Y_FONTS; y_blk++ {
+		for x_blk := 0; x_blk < NUM_X_FONTS; x_blk++ {
+			pixels := d.tilePixels(x_blk, y_blk)
+
+			flat := true
+			for _, row := range pixels {
+				for _, index := range row {
+					if index != preset_color {
+						flat = false
+					}
+				}
+			}
+			if flat {
+				continue
+			}
+
+			for _, cdg_pack := range fontPacks(x_blk, y_blk, pixels) {
+				stream = append(stream, cdg_pack...)
+			}
+		}
+	}
+
+	border_pack := newPack(BORDER_PRESET)
+	border_pack[4] = byte(d.border_index)
+	setPackParity(border_pack)
+	stream = append(stream, border_pack...)
+
+	if d.h_offset != 0 || d.v_offset != 0 {
+		// A scroll with no direction only sets the offsets, VRAM is left alone.
+		scroll_pack := newPack(SCROLL_COPY)
+		scroll_pack[5] = byte(d.h_offset)
+		scroll_pack[6] = byte(d.v_offset)
+		setPackParity(scroll_pack)
+		stream = append(stream, scroll_pack...)
+	}
+
+	return stream
+}
+
+// Cut returns a standalone .cdg covering packs start up to end of cdg_file_data.
+// It begins with preroll packs, from StatePacks, that re-create the screen as it
+// was at start, so the clip renders correctly on any player. The audio for the
+// clip should therefore start preroll packs before start. start and end are
+// clamped to the song.
+func Cut(cdg_file_data []byte, start, end Position) (clip []byte, preroll Position) {
+	total_packs := Position(len(cdg_file_data) / PACK_SIZE)
+	if end > total_packs {
+		end = total_packs
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > end {
+		start = end
+	}
+
+	decoder := NewDecoder()
+	decoder.DecodePacks(cdg_file_data, start)
+
+	clip = decoder.StatePacks()
+	preroll = Position(len(clip) / PACK_SIZE)
+	clip = append(clip, cdg_file_data[start*PACK_SIZE:end*PACK_SIZE]...)
+	return clip, preroll
+}
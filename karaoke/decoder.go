@@ -0,0 +1,700 @@
+// Package karaoke decodes CD+G (CD+Graphics) karaoke subcode data, as found in
+// .cdg files, into 288x192 RGBA frames.
+package karaoke
+
+import (
+	"image"
+)
+
+const (
+	VRAM_SIZE       = 300 * 216 // Total linear size of VRAM, in pixels.
+	VRAM_WIDTH      = 300       // Width (or pitch) of VRAM, in pixels.
+	VRAM_HEIGHT     = 216       // Height of VRAM, in pixels.
+	VISIBLE_SIZE    = 288 * 192 // Total linear size of visible screen, in pixels.
+	VISIBLE_WIDTH   = 288       // Width (or pitch) of visible screen, in pixels.
+	VISIBLE_HEIGHT  = 192       // Height of visible screen, in pixels.
+	FONT_WIDTH      = 6         // Width of  one "font" (or block).
+	FONT_HEIGHT     = 12        // Height of one "font" (or block).
+	NUM_X_FONTS     = 50        // Number of horizontal fonts contained in VRAM.
+	NUM_Y_FONTS     = 18        // Number of vertical fonts contained in VRAM.
+	PALETTE_ENTRIES = 16        // Number of CLUT palette entries.
+	TV_GRAPHICS     = 0x09      // 50x18 (48x16) 16 color TV graphics mode.
+	MEMORY_PRESET   = 0x01      // Set all VRAM to palette index.
+	BORDER_PRESET   = 0x02      // Set border to palette index.
+	//Load Color Lookup Table Commands
+	LOAD_CLUT_LO  = 0x1E // Load Color Look Up Table index 0 through 7.
+	LOAD_CLUT_HI  = 0x1F // Load Color Look Up Table index 8 through 15.
+	COPY_FONT     = 0x06 // Copy 12x6 pixel font to screen.
+	XOR_FONT      = 0x26 // XOR 12x6 pixel font with existing VRAM values.
+	SCROLL_PRESET = 0x14 // Update scroll offset, copying if 0x20 or 0x10.
+	SCROLL_COPY   = 0x18 // Update scroll offset, setting color if 0x20 or 0x10.
+	//Not implemented by the decoder, but recognised by the validator
+	SET_TRANSPARENT = 0x1C // Set 6 bit transparency of each CLUT entry.
+
+	PACK_SIZE        = 24  // Size of one subcode pack, in bytes.
+	PACKS_PER_SECOND = 300 // 75 sectors per second, 4 packs per sector.
+)
+
+// A Decoder holds the state of one CD+G "player": the color table, VRAM and the
+// pack position reached so far. Decoders are independent of each other, so any
+// number of songs can be decoded at the same time, but a single Decoder must not
+// be used from more than one goroutine at once.
+type Decoder struct {
+	//I think they should probably be 32 bit colors based on the proc_LOAD_CLUT function
+	palette        []int
+	vram           []int
+	dirty_blocks   []byte
+	rgba_context   *image.RGBA
+	rgba_imagedata []uint8
+	usedirtyrect   bool
+
+	border_index int // The current border palette index.
+	current_pack int
+
+	// Fine scroll offsets from the last scroll instruction, in pixels. They're
+	// tracked so the state can be re-created, but not yet applied when rendering.
+	h_offset int
+	v_offset int
+
+	border_dirty bool
+	screen_dirty bool
+}
+
+// NewDecoder returns a Decoder in the same state as a freshly reset player.
+func NewDecoder() *Decoder {
+	d := &Decoder{
+		palette:      make([]int, PALETTE_ENTRIES),
+		vram:         make([]int, NUM_X_FONTS*VRAM_HEIGHT),
+		dirty_blocks: make([]byte, 900),
+		rgba_context: image.NewRGBA(image.Rect(0, 0, VISIBLE_WIDTH, VISIBLE_HEIGHT)),
+		usedirtyrect: true,
+	}
+	d.rgba_imagedata = d.rgba_context.Pix
+	return d
+}
+
+// Image returns the RGBA frame the render functions draw into. It is reused by
+// every redraw, so copy it if it has to outlive the next call.
+func (d *Decoder) Image() *image.RGBA {
+	return d.rgba_context
+}
+
+// RenderScreen renders the whole visible screen, regardless of what is dirty.
+func (d *Decoder) RenderScreen() *image.RGBA {
+	d.render_screen_to_rgb()
+	d.screen_dirty = false
+	d.clearDirtyBlocks()
+	return d.rgba_context
+}
+
+// CurrentPack returns the playback position decoded so far.
+func (d *Decoder) CurrentPack() Position {
+	return Position(d.current_pack)
+}
+
+// BorderIndex returns the palette index of the border.
+func (d *Decoder) BorderIndex() int {
+	return d.border_index
+}
+
+// ScrollOffsets returns the fine horizontal and vertical scroll offsets, in pixels.
+func (d *Decoder) ScrollOffsets() (h_offset, v_offset int) {
+	return d.h_offset, d.v_offset
+}
+
+// BorderColor returns the current border color as 0xRRGGBB.
+func (d *Decoder) BorderColor() int {
+	return d.palette[d.border_index]
+}
+
+// Palette returns the current color table as 0xRRGGBB values. The slice belongs
+// to the Decoder and changes as packs are decoded.
+func (d *Decoder) Palette() []int {
+	return d.palette
+}
+
+// SetPalette replaces the color table, as LOAD_CLUT instructions would, and
+// marks the screen for redrawing.
+func (d *Decoder) SetPalette(palette []int) {
+	copy(d.palette, palette)
+	d.screen_dirty = true
+	d.border_dirty = true
+}
+
+// FadePalette returns the colors of palette moved amount of the way, from 0 to
+// 1, towards the 0xRRGGBB color to.
+func FadePalette(palette []int, to int, amount float64) []int {
+	faded := make([]int, len(palette))
+	for idx, color := range palette {
+		for shift := uint(0); shift < 24; shift += 8 {
+			from, target := float64(color>>shift&0xFF), float64(to>>shift&0xFF)
+			faded[idx] |= int(from+(target-from)*amount+0.5) << shift
+		}
+	}
+	return faded
+}
+
+// VRAM returns the raw 300x216 pixel memory, six 4 bit palette indices packed
+// into each int, NUM_X_FONTS ints per line. It belongs to the Decoder.
+func (d *Decoder) VRAM() []int {
+	return d.vram
+}
+
+// Reset blanks the screen and color table and rewinds to pack 0, ready for a new song.
+func (d *Decoder) Reset() {
+	d.current_pack = 0x00
+	d.border_index = 0x00
+	d.h_offset = 0x00
+	d.v_offset = 0x00
+	d.clearPalette()
+	d.clearVRAM(0x00)
+	d.clearDirtyBlocks()
+}
+
+func (d *Decoder) clearPalette() {
+	for idx := 0; idx < PALETTE_ENTRIES; idx++ {
+		d.palette[idx] = 0x00
+	}
+}
+
+func (d *Decoder) get_current_pack() byte {
+	//casting: must test!!!
+	return byte(d.current_pack)
+}
+
+/* Possibly not needed!
+func set_dirtyrect(requested_value) {
+	d.usedirtyrect = requested_value
+}
+*/
+
+// Not sure I need this function
+func (d *Decoder) putImageData(imageData []byte, x, y, dirtyX, dirtyY, dirtyWidth, dirtyHeight int) {
+
+}
+
+// RedrawCanvas brings Image up to date with everything decoded so far.
+func (d *Decoder) RedrawCanvas() {
+
+	if d.screen_dirty {
+		d.render_screen_to_rgb()
+		d.screen_dirty = false
+		d.clearDirtyBlocks()
+		// d.rgba_context.putImageData(d.rgba_imagedata, 0, 0)
+	} else {
+		//var local_context = d.rgba_context
+		//var local_rgba_imagedata = d.rgba_imagedata
+
+		update_needed := false
+		var blk = 0x00
+
+		//NOTE: test the post-increment (Go does not have pre, so had to change it)
+
+		for y_blk := 1; y_blk <= 16; y_blk++ {
+
+			blk = y_blk*NUM_X_FONTS + 1
+
+			for x_blk := 1; x_blk <= 48; x_blk++ {
+
+				//this dirty logic not quite working!!!
+				//if d.dirty_blocks[blk] != 0 {
+				d.render_block_to_rgb(x_blk, y_blk)
+
+				if d.usedirtyrect {
+					//api call looks like this
+					//context.putImageData(imgData,x,y,dirtyX,dirtyY,dirtyWidth,dirtyHeight);
+					// local_context.putImageData(local_rgba_imagedata, 0, 0,
+					// 	(x_blk-1)*FONT_WIDTH,
+					// 	(y_blk-1)*FONT_HEIGHT,
+					// 	FONT_WIDTH,
+					// 	FONT_HEIGHT)
+				} else {
+					update_needed = true
+				}
+
+				d.dirty_blocks[blk] = 0x00
+				//}
+				//Note: test the post-increment
+				blk++
+			}
+		}
+		// Update the whole screen for browsers where dirty rect isn't supported.
+		// Since this can't be detected(???) in any way, it has to be User Agent selected, or an actual user option.
+		// TODO: See if a dirty rect-based partial update of known pixel values combined with a getImageData
+		//       call could be used to determine if it works correctly *without* evil browser sniffing.
+		if update_needed {
+			//local_context.putImageData(local_rgba_imagedata, 0, 0);
+		}
+	}
+}
+
+// Decode to pack playback_position, using cdg_file_data.
+// Positions past the end of the data are clamped to the last whole pack, and
+// positions before the start to the first.
+func (d *Decoder) DecodePacks(cdg_file_data []byte, position Position) {
+
+	playback_position := int(position)
+	if total_packs := len(cdg_file_data) / PACK_SIZE; playback_position > total_packs {
+		playback_position = total_packs
+	}
+	if playback_position < 0 {
+		playback_position = 0
+	}
+
+	for curr_pack := d.current_pack; curr_pack < playback_position; curr_pack++ {
+
+		start_offset := curr_pack * PACK_SIZE
+		curr_command := cdg_file_data[start_offset] & 0x3F
+
+		if curr_command == TV_GRAPHICS {
+			// Slice the file array down to a single pack array.
+			this_pack := cdg_file_data[start_offset : start_offset+PACK_SIZE]
+			// Pluck out the graphics instruction.
+			curr_instruction := this_pack[1] & 0x3F
+			// Perform the instruction action.
+			switch curr_instruction {
+			case MEMORY_PRESET:
+				d.proc_MEMORY_PRESET(this_pack)
+
+			case BORDER_PRESET:
+				d.proc_BORDER_PRESET(this_pack)
+
+			case LOAD_CLUT_LO, LOAD_CLUT_HI:
+				d.proc_LOAD_CLUT(this_pack)
+
+			case COPY_FONT:
+				d.proc_WRITE_FONT(this_pack, false)
+
+			case XOR_FONT:
+				d.proc_WRITE_FONT(this_pack, true)
+
+			case SCROLL_PRESET, SCROLL_COPY:
+				d.proc_DO_SCROLL(this_pack)
+
+			}
+		}
+	}
+	d.current_pack = playback_position
+}
+
+func fill_line_with_palette_index(requested_index int) int {
+
+	adjusted_value := requested_index          // Pixel 0
+	adjusted_value |= (requested_index << 004) // Pixel 1
+	adjusted_value |= (requested_index << 010) // Pixel 2
+	adjusted_value |= (requested_index << 014) // Pixel 3
+	adjusted_value |= (requested_index << 020) // Pixel 4
+	adjusted_value |= (requested_index << 024) // Pixel 5
+
+	return adjusted_value
+}
+
+func (d *Decoder) clearDirtyBlocks() {
+	for blk := 0; blk < 900; blk++ {
+		d.dirty_blocks[blk] = 0x00
+	}
+}
+
+func (d *Decoder) clearVRAM(colorIndex int) {
+
+	packed_line_value := fill_line_with_palette_index(colorIndex)
+
+	for pxl := 0; pxl < len(d.vram); pxl++ {
+		d.vram[pxl] = packed_line_value
+	}
+
+	d.screen_dirty = true
+}
+
+func (d *Decoder) render_screen_to_rgb() {
+
+	vis_width := 48
+	vis_height := VISIBLE_HEIGHT
+
+	vram_loc := 601           // Offset into VRAM array.
+	rgb_loc := 0x00           // Offset into RGBA array.
+	curr_rgb := 0x00          // RGBA value of current pixel.
+	curr_line_indices := 0x00 // Packed font row index values.
+
+	for y_pxl := 0; y_pxl < vis_height; y_pxl++ {
+		for x_pxl := 0; x_pxl < vis_width; x_pxl++ {
+
+			//for the Go version, maybe don't have to unroll the loop cause it's getting ugly.
+			//NOTE: these values are shifted by Octal numbers looks like ie: 010
+			//NOTE: In Go, ++ is a statement not expression, so had to post-increment after-the-fact
+
+			curr_line_indices = d.vram[vram_loc] // Get the current line segment indices.
+			vram_loc++
+
+			curr_rgb = d.palette[(curr_line_indices>>000)&0x0F] // Get the RGB value for pixel 0.
+
+			d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 020) & 0xFF) // Set red value for pixel 0.
+			rgb_loc++
+			d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 010) & 0xFF) // Set green value for pixel 0.
+			rgb_loc++
+			d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 000) & 0xFF) // Set blue value for pixel 0.
+			rgb_loc++
+			d.rgba_imagedata[rgb_loc] = byte(0xFF) // Set alpha value (fully opaque) for pixel 0.
+			rgb_loc++
+
+			curr_rgb = d.palette[(curr_line_indices>>004)&0x0F] // Get the RGB value for pixel 1.
+
+			d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 020) & 0xFF) // Set red value for pixel 1.
+			rgb_loc++
+			d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 010) & 0xFF) // Set green value for pixel 1.
+			rgb_loc++
+			d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 000) & 0xFF) // Set blue value for pixel 1.
+			rgb_loc++
+			d.rgba_imagedata[rgb_loc] = byte(0xFF) // Set alpha value (fully opaque) for pixel 1.
+			rgb_loc++
+
+			curr_rgb = d.palette[(curr_line_indices>>010)&0x0F] // Get the RGB value for pixel 2.
+
+			d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 020) & 0xFF) // Set red value for pixel 2.
+			rgb_loc++
+			d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 010) & 0xFF) // Set green value for pixel 2.
+			rgb_loc++
+			d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 000) & 0xFF) // Set blue value for pixel 2.
+			rgb_loc++
+			d.rgba_imagedata[rgb_loc] = byte(0xFF) // Set alpha value (fully opaque) for pixel 2.
+			rgb_loc++
+
+			curr_rgb = d.palette[(curr_line_indices>>014)&0x0F] // Get the RGB value for pixel 3.
+
+			d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 020) & 0xFF) // Set red value for pixel 3.
+			rgb_loc++
+			d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 010) & 0xFF) // Set green value for pixel 3.
+			rgb_loc++
+			d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 000) & 0xFF) // Set blue value for pixel 3.
+			rgb_loc++
+			d.rgba_imagedata[rgb_loc] = byte(0xFF) // Set alpha value (fully opaque) for pixel 3.
+			rgb_loc++
+
+			curr_rgb = d.palette[(curr_line_indices>>020)&0x0F] // Get the RGB value for pixel 4.
+
+			d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 020) & 0xFF) // Set red value for pixel 4.
+			rgb_loc++
+			d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 010) & 0xFF) // Set green value for pixel 4.
+			rgb_loc++
+			d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 000) & 0xFF) // Set blue value for pixel 4.
+			rgb_loc++
+			d.rgba_imagedata[rgb_loc] = byte(0xFF) // Set alpha value (fully opaque) for pixel 4.
+			rgb_loc++
+
+			curr_rgb = d.palette[(curr_line_indices>>024)&0x0F] // Get the RGB value for pixel 5.
+
+			d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 020) & 0xFF) // Set red value for pixel 5.
+			rgb_loc++
+			d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 010) & 0xFF) // Set green value for pixel 5.
+			rgb_loc++
+			d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 000) & 0xFF) // Set blue value for pixel 5.
+			rgb_loc++
+			d.rgba_imagedata[rgb_loc] = byte(0xFF) // Set alpha value (fully opaque) for pixel 5.
+			rgb_loc++
+
+			// Or, instead, index 0 could be set transparent to show background image/video.
+			// Alternately, SET_TRANSPARENT instruction could be implemented to set 6bit transparency.
+			// Unfortunately, I don't think many (any?) discs bother to set it :-/...
+		}
+		vram_loc += 2 // Skip the offscreen font blocks.
+	}
+}
+
+func (d *Decoder) render_block_to_rgb(x_start, y_start int) {
+	vram_loc := (y_start * NUM_X_FONTS * FONT_HEIGHT) + x_start // Offset into VRAM array.
+	vram_inc := NUM_X_FONTS
+	vram_end := vram_loc + (NUM_X_FONTS * FONT_HEIGHT)     // VRAM location to end.
+	rgb_loc := (y_start - 1) * FONT_HEIGHT * VISIBLE_WIDTH // Row start.
+	rgb_loc += (x_start - 1) * FONT_WIDTH                  // Column start
+	rgb_loc *= 4                                           // RGBA, 1 pxl = 4 bytes.
+
+	rgb_inc := (VISIBLE_WIDTH - FONT_WIDTH) * 4
+	curr_rgb := 0x00          // RGBA value of current pixel.
+	curr_line_indices := 0x00 // Packed font row index values.
+
+	for vram_loc < vram_end {
+		curr_line_indices = d.vram[vram_loc]                       // Get the current line segment indices.
+		curr_rgb = d.palette[(curr_line_indices>>000)&0x0F]        // Get the RGB value for pixel 0.
+		d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 020) & 0xFF) // Set red value for pixel 0.
+		rgb_loc++
+		d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 010) & 0xFF) // Set green value for pixel 0.
+		rgb_loc++
+		d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 000) & 0xFF) // Set blue value for pixel 0.
+		rgb_loc++
+		d.rgba_imagedata[rgb_loc] = byte(0xFF)
+		rgb_loc++                                                  // Set alpha value (fully opaque) for pixel 0.
+		curr_rgb = d.palette[(curr_line_indices>>004)&0x0F]        // Get the RGB value for pixel 1.
+		d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 020) & 0xFF) // Set red value for pixel 1.
+		rgb_loc++
+		d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 010) & 0xFF) // Set green value for pixel 1.
+		rgb_loc++
+		d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 000) & 0xFF) // Set blue value for pixel 1.
+		rgb_loc++
+		d.rgba_imagedata[rgb_loc] = byte(0xFF)
+		rgb_loc++                                                  // Set alpha value (fully opaque) for pixel 1.
+		curr_rgb = d.palette[(curr_line_indices>>010)&0x0F]        // Get the RGB value for pixel 2.
+		d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 020) & 0xFF) // Set red value for pixel 2.
+		rgb_loc++
+		d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 010) & 0xFF) // Set green value for pixel 2.
+		rgb_loc++
+		d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 000) & 0xFF) // Set blue value for pixel 2.
+		rgb_loc++
+		d.rgba_imagedata[rgb_loc] = byte(0xFF)
+		rgb_loc++                                                  // Set alpha value (fully opaque) for pixel 2.
+		curr_rgb = d.palette[(curr_line_indices>>014)&0x0F]        // Get the RGB value for pixel 3.
+		d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 020) & 0xFF) // Set red value for pixel 3.
+		rgb_loc++
+		d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 010) & 0xFF) // Set green value for pixel 3.
+		rgb_loc++
+		d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 000) & 0xFF) // Set blue value for pixel 3.
+		rgb_loc++
+		d.rgba_imagedata[rgb_loc] = byte(0xFF)
+		rgb_loc++                                                  // Set alpha value (fully opaque) for pixel 3.
+		curr_rgb = d.palette[(curr_line_indices>>020)&0x0F]        // Get the RGB value for pixel 4.
+		d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 020) & 0xFF) // Set red value for pixel 4.
+		rgb_loc++
+		d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 010) & 0xFF) // Set green value for pixel 4.
+		rgb_loc++
+		d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 000) & 0xFF) // Set blue value for pixel 4.
+		rgb_loc++
+		d.rgba_imagedata[rgb_loc] = byte(0xFF)
+		rgb_loc++                                                  // Set alpha value (fully opaque) for pixel 4.
+		curr_rgb = d.palette[(curr_line_indices>>024)&0x0F]        // Get the RGB value for pixel 5.
+		d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 020) & 0xFF) // Set red value for pixel 5.
+		rgb_loc++
+		d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 010) & 0xFF) // Set green value for pixel 5.
+		rgb_loc++
+		d.rgba_imagedata[rgb_loc] = byte((curr_rgb >> 000) & 0xFF) // Set blue value for pixel 5.
+		rgb_loc++
+		d.rgba_imagedata[rgb_loc] = byte(0xFF) // Set alpha value (fully opaque) for pixel 5.
+		rgb_loc++
+		// Or, instead, index 0 could be set transparent to show background image/video.
+		// Alternately, SET_TRANSPARENT instruction could be implemented to set 6bit transparency.
+		// Unfortunately, I don't think many (any?) discs bother to set it :-/...
+		vram_loc += vram_inc // Move to the first column of the next row of this font block in VRAM.
+		rgb_loc += rgb_inc   // Move to the first column of the next row of this font block in RGB pixels.
+	}
+}
+
+//########## PRIVATE GRAPHICS DECODE FUNCTIONS ##########//
+
+func (d *Decoder) proc_BORDER_PRESET(cdg_pack []byte) {
+	// NOTE: The "border" is actually a DIV element, which can be very expensive to change in some browsers.
+	// This somewhat bizarre check ensures that the DIV is only touched if the actual RGB color is different,
+	// but the border index variable is always set... A similar check is also performed during palette update.
+	new_border_index := int(cdg_pack[4] & 0x3F) // Get the border index from subcode.
+	// A 6 bit index can point past the 16 entry CLUT on damaged data, ignore it rather than panic.
+	if new_border_index >= PALETTE_ENTRIES {
+		return
+	}
+	// Check if the new border **RGB** color is different from the old one.
+	if d.palette[new_border_index] != d.palette[d.border_index] {
+		d.border_dirty = true // Border needs updating.
+	}
+
+	d.border_index = new_border_index // Set the new index.
+}
+
+func (d *Decoder) proc_MEMORY_PRESET(cdg_pack []byte) {
+	d.clearVRAM(int(cdg_pack[4] & 0x3F))
+}
+
+// Verified function works accordingly per JS version.
+func (d *Decoder) proc_LOAD_CLUT(cdg_pack []byte) {
+
+	// If instruction is 0x1E then 8*0=0, if 0x1F then 8*1=8 for offset.
+	pal_offset := int((cdg_pack[1] & 0x01) * 8)
+	// Step through the eight color indices, setting the RGB values.
+	for pal_inc := 0; pal_inc < 8; pal_inc++ {
+		temp_idx := pal_inc + pal_offset
+		temp_rgb := 0x00000000
+		temp_entry := 0x00000000
+		// Set red.
+		temp_entry = (int(cdg_pack[pal_inc*2+4]) & 0x3C) >> 2
+		temp_rgb |= (temp_entry * 17) << 020
+		// Set green.
+		temp_entry = ((int(cdg_pack[pal_inc*2+4]) & 0x03) << 2) | ((int(cdg_pack[pal_inc*2+5]) & 0x30) >> 4)
+		temp_rgb |= (temp_entry * 17) << 010
+		// Set blue.
+		temp_entry = int(cdg_pack[pal_inc*2+5]) & 0x0F
+		temp_rgb |= (temp_entry * 17) << 000
+
+		// Put the full RGB value into the index position, but only if it's different.
+		if temp_rgb != d.palette[temp_idx] {
+			d.palette[temp_idx] = temp_rgb
+			d.screen_dirty = true // The colors are now different, so we need to update the whole screen.
+
+			if temp_idx == d.border_index {
+				d.border_dirty = true
+			} // The border color has changed.
+		}
+	}
+}
+
+func (d *Decoder) proc_WRITE_FONT(cdg_pack []byte, xor_var bool) {
+	// Hacky hack to play channels 0 and 1 only... Ideally, there should be a function and user option to get/set.
+	active_channels := 0x03
+	// First, get the channel...
+	subcode_channel := ((cdg_pack[4] & 0x30) >> 2) | ((cdg_pack[5] & 0x30) >> 4)
+
+	// Then see if we should display it.
+	if ((active_channels >> subcode_channel) & 0x01) != 0 {
+		x_location := cdg_pack[7] & 0x3F // Get horizontal font location.
+		y_location := cdg_pack[6] & 0x1F // Get vertical font location.
+
+		// Verify we're not going to overrun the boundaries (i.e. bad data from a scratched disc).
+		if (x_location <= 49) && (y_location <= 17) {
+			start_pixel := int(y_location)*600 + int(x_location) // Location of first pixel of this font in linear VRAM.
+			// NOTE: Profiling indicates charCodeAt() uses ~80% of the CPU consumed for this function.
+			// Caching these values reduces that to a negligible amount.
+
+			current_indexes := make([]int, 2)
+			current_indexes[0] = int(cdg_pack[4]) & 0x0F
+			current_indexes[1] = int(cdg_pack[5]) & 0x0F
+
+			current_row := 0x00 // Subcode byte for current pixel row.
+			temp_pxl := 0x00    // Decoded and packed 4bit pixel index values of current row.
+			for y_inc := 0; y_inc < 12; y_inc++ {
+				pix_pos := y_inc*50 + start_pixel    // Location of the first pixel of this row in linear VRAM.
+				current_row = int(cdg_pack[y_inc+8]) // Get the subcode byte for the current row.
+				temp_pxl = (current_indexes[(current_row>>5)&0x01] << 000)
+				temp_pxl |= (current_indexes[(current_row>>4)&0x01] << 004)
+				temp_pxl |= (current_indexes[(current_row>>3)&0x01] << 010)
+				temp_pxl |= (current_indexes[(current_row>>2)&0x01] << 014)
+				temp_pxl |= (current_indexes[(current_row>>1)&0x01] << 020)
+				temp_pxl |= (current_indexes[(current_row>>0)&0x01] << 024)
+
+				//NOTE: figure out truthy-ness of xor_var
+				if xor_var {
+					d.vram[pix_pos] ^= temp_pxl
+				} else {
+					d.vram[pix_pos] = temp_pxl
+				}
+			} // End of Y loop.
+			// Mark this block as needing an update.
+			d.dirty_blocks[y_location*50+x_location] = 0x01
+		} // End of location check.
+	} // End of channel check.
+}
+
+func (d *Decoder) proc_DO_SCROLL(cdg_pack []byte) {
+	direction := byte(0)                   // H/V direction flag.
+	copy_flag := (cdg_pack[1] & 0x08) >> 3 // Type of copy (memory preset or copy).
+	color := int(cdg_pack[4] & 0x0F)       // Color index to use for preset type.
+
+	d.h_offset = int(cdg_pack[5] & 0x07) // Horizontal fine scroll, 0-5 pixels.
+	d.v_offset = int(cdg_pack[6] & 0x0F) // Vertical fine scroll, 0-11 pixels.
+
+	//TODOD: check what value of direction is
+	// Process horizontal commands.
+	if direction = (cdg_pack[5] & 0x30) >> 4; direction != 0 {
+		d.proc_VRAM_HSCROLL(direction, copy_flag, color)
+	}
+
+	// Process vertical commands.
+	if direction = (cdg_pack[6] & 0x30) >> 4; direction != 0 {
+		d.proc_VRAM_VSCROLL(direction, copy_flag, color)
+	}
+
+	d.screen_dirty = true // Entire screen needs to be redrawn.
+}
+
+func (d *Decoder) proc_VRAM_HSCROLL(direction byte, copy_flag byte, color int) {
+
+	buf := 0
+	line_color := fill_line_with_palette_index(color)
+
+	if direction == 0x02 {
+		// Step through the lines one at a time...
+		for y_src := 0; y_src < (50 * 216); y_src += 50 {
+			y_start := y_src
+			buf = d.vram[y_start]
+
+			for x_src := y_start + 1; x_src < y_start+50; x_src++ {
+				d.vram[x_src-1] = d.vram[x_src]
+			}
+
+			if copy_flag != 0 {
+				d.vram[y_start+49] = buf
+			} else {
+				d.vram[y_start+49] = line_color
+			}
+		}
+	} else if direction == 0x01 {
+		// Step through the lines on at a time.
+		for y_src := 0; y_src < (50 * 216); y_src += 50 {
+			// Copy the last six lines to the buffer.
+			y_start := y_src
+			buf = d.vram[y_start+49]
+
+			for x_src := y_start + 48; x_src >= y_start; x_src-- {
+				d.vram[x_src+1] = d.vram[x_src]
+			}
+
+			if copy_flag != 0 {
+				d.vram[y_start] = buf
+			} else {
+				d.vram[y_start] = line_color
+			}
+		}
+	}
+}
+
+func (d *Decoder) proc_VRAM_VSCROLL(direction byte, copy_flag byte, color int) {
+
+	offscreen_size := NUM_X_FONTS * FONT_HEIGHT
+	buf := make([]int, offscreen_size)
+
+	line_color := fill_line_with_palette_index(color)
+
+	if direction == 0x02 {
+		dst_idx := 0 // Buffer destination starts at 0.
+		// Copy the top 300x12 pixels into the buffer.
+		for src_idx := 0; src_idx < offscreen_size; src_idx++ {
+			buf[dst_idx] = d.vram[src_idx]
+			dst_idx++
+		}
+
+		dst_idx = 0 // Destination starts at the first line.
+
+		for src_idx := offscreen_size; src_idx < (50 * 216); src_idx++ {
+			d.vram[dst_idx] = d.vram[src_idx]
+			dst_idx++
+		}
+
+		dst_idx = NUM_X_FONTS * 204 // Destination begins at line 204.
+
+		if copy_flag != 0 {
+			for src_idx := 0; src_idx < offscreen_size; src_idx++ {
+				d.vram[dst_idx] = buf[src_idx]
+				dst_idx++
+			}
+		} else {
+			for src_idx := 0; src_idx < offscreen_size; src_idx++ {
+				d.vram[dst_idx] = line_color
+				dst_idx++
+			}
+		}
+	} else if direction == 0x01 {
+		dst_idx := 0 // Buffer destination starts at 0.
+		// Copy the bottom 300x12 pixels into the buffer.
+		for src_idx := (50 * 204); src_idx < (50 * 216); src_idx++ {
+			buf[dst_idx] = d.vram[src_idx]
+			dst_idx++
+		}
+
+		for src_idx := (50 * 204) - 1; src_idx > 0; src_idx-- {
+			d.vram[src_idx+offscreen_size] = d.vram[src_idx]
+		}
+
+		if copy_flag != 0 {
+			for src_idx := 0; src_idx < offscreen_size; src_idx++ {
+				d.vram[src_idx] = buf[src_idx]
+			}
+		} else {
+			for src_idx := 0; src_idx < offscreen_size; src_idx++ {
+				d.vram[src_idx] = line_color
+			}
+		}
+	}
+}
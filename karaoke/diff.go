@@ -0,0 +1,125 @@
+package karaoke
+
+import (
+	"image"
+)
+
+// statesDiffer reports what, if anything, differs between two decoders.
+func statesDiffer(a, b *Decoder) string {
+	for idx := range a.palette {
+		if a.palette[idx] != b.palette[idx] {
+			return "palette"
+		}
+	}
+	if a.BorderColor() != b.BorderColor() {
+		return "border"
+	}
+	for idx := range a.vram {
+		if a.vram[idx]&0xFFFFFF != b.vram[idx]&0xFFFFFF {
+			return "vram"
+		}
+	}
+	return ""
+}
+
+// A DiffRange is a run of packs, End exclusive, over which two songs look different.
+type DiffRange struct {
+	StartPack Position `json:"start_pack"`
+	EndPack   Position `json:"end_pack"`
+	Start     float64  `json:"start_seconds"`
+	End       float64  `json:"end_seconds"`
+	Reason    string   `json:"reason"`
+}
+
+// A DiffReport is the result of decoding two .cdg files in lockstep.
+type DiffReport struct {
+	A         string      `json:"a"`
+	B         string      `json:"b"`
+	PacksA    int         `json:"packs_a"`
+	PacksB    int         `json:"packs_b"`
+	FirstDiff Position    `json:"first_diff"` // -1 if the files look identical.
+	Ranges    []DiffRange `json:"ranges"`
+}
+
+// Diff decodes a_data and b_data pack by pack and records every range over
+// which their VRAM, palette or border color differ. If frame is not nil it is
+// called with the first pack of each range, just after both decoders decoded it.
+func Diff(a_data, b_data []byte, frame func(pack Position, a, b *Decoder) error) (*DiffReport, error) {
+	report := &DiffReport{
+		PacksA:    len(a_data) / PACK_SIZE,
+		PacksB:    len(b_data) / PACK_SIZE,
+		FirstDiff: -1,
+		Ranges:    []DiffRange{},
+	}
+
+	total_packs := Position(report.PacksA)
+	if Position(report.PacksB) > total_packs {
+		total_packs = Position(report.PacksB)
+	}
+
+	a := NewDecoder()
+	b := NewDecoder()
+	var open *DiffRange
+
+	for pack := Position(0); pack < total_packs; pack++ {
+		a.DecodePacks(a_data, pack+1)
+		b.DecodePacks(b_data, pack+1)
+
+		reason := statesDiffer(a, b)
+		switch {
+		case reason != "" && open == nil:
+			report.Ranges = append(report.Ranges, DiffRange{StartPack: pack, Reason: reason})
+			open = &report.Ranges[len(report.Ranges)-1]
+			if report.FirstDiff < 0 {
+				report.FirstDiff = pack
+			}
+			if frame != nil {
+				if err := frame(pack, a, b); err != nil {
+					return report, err
+				}
+			}
+		case reason == "" && open != nil:
+			open.EndPack = pack
+			open = nil
+		}
+	}
+	if open != nil {
+		open.EndPack = total_packs
+	}
+
+	for idx := range report.Ranges {
+		report.Ranges[idx].Start = report.Ranges[idx].StartPack.Seconds()
+		report.Ranges[idx].End = report.Ranges[idx].EndPack.Seconds()
+	}
+	return report, nil
+}
+
+// SideBySide puts the two frames next to each other with a thin white gap.
+func SideBySide(a, b *image.RGBA) *image.RGBA {
+	const gap = 4
+	dst := image.NewRGBA(image.Rect(0, 0, VISIBLE_WIDTH*2+gap, VISIBLE_HEIGHT))
+	for idx := range dst.Pix {
+		dst.Pix[idx] = 0xFF
+	}
+	row_bytes := VISIBLE_WIDTH * 4
+	for y := 0; y < VISIBLE_HEIGHT; y++ {
+		copy(dst.Pix[dst.PixOffset(0, y):], a.Pix[a.PixOffset(0, y):a.PixOffset(0, y)+row_bytes])
+		copy(dst.Pix[dst.PixOffset(VISIBLE_WIDTH+gap, y):], b.Pix[b.PixOffset(0, y):b.PixOffset(0, y)+row_bytes])
+	}
+	return dst
+}
+
+// HighlightDiff dims frame a and paints every pixel that differs in b magenta.
+func HighlightDiff(a, b *image.RGBA) *image.RGBA {
+	dst := image.NewRGBA(a.Bounds())
+	for idx := 0; idx < len(a.Pix); idx += 4 {
+		if a.Pix[idx] != b.Pix[idx] || a.Pix[idx+1] != b.Pix[idx+1] || a.Pix[idx+2] != b.Pix[idx+2] {
+			dst.Pix[idx], dst.Pix[idx+1], dst.Pix[idx+2] = 0xFF, 0x00, 0xFF
+		} else {
+			luma := (int(a.Pix[idx])*299 + int(a.Pix[idx+1])*587 + int(a.Pix[idx+2])*114) / 1000
+			dst.Pix[idx], dst.Pix[idx+1], dst.Pix[idx+2] = byte(luma/3), byte(luma/3), byte(luma/3)
+		}
+		dst.Pix[idx+3] = 0xFF
+	}
+	return dst
+}
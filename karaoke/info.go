@@ -0,0 +1,55 @@
+package karaoke
+
+// Info summarises what is in a .cdg file without decoding it.
+type Info struct {
+	File          string         `json:"file"`
+	Size          int            `json:"size"`
+	Packs         int            `json:"packs"`
+	Length        Position       `json:"-"`
+	Duration      float64        `json:"duration_seconds"`
+	GraphicsPacks int            `json:"graphics_packs"`
+	Instructions  map[string]int `json:"instructions"`
+	Channels      map[int]int    `json:"channels"`        // Font packs per subcode channel.
+	FirstPalette  int            `json:"first_palette"`   // Pack of the first LOAD_CLUT, or -1.
+	Audio         string         `json:"audio,omitempty"` // The audio paired with the song, if known.
+	AudioRate     int            `json:"audio_sample_rate,omitempty"`
+	AudioDuration float64        `json:"audio_duration_seconds,omitempty"`
+	AudioError    string         `json:"audio_error,omitempty"` // Why the audio couldn't be decoded.
+}
+
+// Inspect counts the TV graphics instructions and subcode channels used by
+// cdg_file_data.
+func Inspect(name string, cdg_file_data []byte) *Info {
+	info := &Info{
+		File:         name,
+		Size:         len(cdg_file_data),
+		Packs:        len(cdg_file_data) / PACK_SIZE,
+		Instructions: make(map[string]int),
+		Channels:     make(map[int]int),
+		FirstPalette: -1,
+	}
+	info.Length = Position(info.Packs)
+	info.Duration = info.Length.Seconds()
+
+	for curr_pack := 0; curr_pack < info.Packs; curr_pack++ {
+		this_pack := cdg_file_data[curr_pack*PACK_SIZE : (curr_pack+1)*PACK_SIZE]
+		if this_pack[0]&0x3F != TV_GRAPHICS {
+			continue
+		}
+		info.GraphicsPacks++
+
+		curr_instruction := this_pack[1] & 0x3F
+		info.Instructions[InstructionName(curr_instruction)]++
+
+		switch curr_instruction {
+		case LOAD_CLUT_LO, LOAD_CLUT_HI:
+			if info.FirstPalette < 0 {
+				info.FirstPalette = curr_pack
+			}
+		case COPY_FONT, XOR_FONT:
+			subcode_channel := int(((this_pack[4] & 0x30) >> 2) | ((this_pack[5] & 0x30) >> 4))
+			info.Channels[subcode_channel]++
+		}
+	}
+	return info
+}
@@ -0,0 +1,280 @@
+package karaoke
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// LIBRARY_EXTENSIONS are the files a Library indexes as songs. Audio files
+// belong to the .cdg with the same name, so they aren't indexed on their own.
+var LIBRARY_EXTENSIONS = []string{".cdg", ".zip"}
+
+// A LibrarySong is what a Library knows about one song. It isn't changed once
+// it is in the index; a rescan replaces it.
+type LibrarySong struct {
+	ID          string    `json:"id"`
+	Path        string    `json:"path"` // Relative to the library directory.
+	Artist      string    `json:"artist"`
+	Title       string    `json:"title"`
+	Code        string    `json:"code,omitempty"` // The manufacturer's disc and track, such as SC8113-01.
+	Duration    float64   `json:"duration_seconds"`
+	Channels    []int     `json:"channels"` // Subcode channels the graphics are drawn on.
+	HasAudio    bool      `json:"has_audio"`
+	AudioFormat string    `json:"audio_format,omitempty"`
+	Size        int64     `json:"size"`
+	Modified    time.Time `json:"modified"`
+}
+
+// A Library is an index of the songs under a directory, for finding them by
+// artist or title without opening every file. All methods are safe to call
+// from any goroutine.
+type Library struct {
+	dir string
+
+	mu         sync.RWMutex
+	songs      []*LibrarySong // By artist, then title.
+	by_id      map[string]*LibrarySong
+	thumbnails map[string]Position // The frame picked for each song's thumbnail.
+}
+
+// NewLibrary returns an empty index of dir; Scan fills it.
+func NewLibrary(dir string) *Library {
+	return &Library{
+		dir:        dir,
+		by_id:      make(map[string]*LibrarySong),
+		thumbnails: make(map[string]Position),
+	}
+}
+
+// Dir returns the directory the library indexes.
+func (l *Library) Dir() string {
+	return l.dir
+}
+
+// Scan walks the library directory and rebuilds the index. Songs that haven't
+// changed since the last scan are kept as they were rather than read again.
+// A song that can't be read is left out, and returned among the problems; err
+// is only for a directory that can't be walked at all.
+func (l *Library) Scan() (problems []error, err error) {
+	l.mu.RLock()
+	previous := make(map[string]*LibrarySong, len(l.songs))
+	for _, song := range l.songs {
+		previous[song.Path] = song
+	}
+	l.mu.RUnlock()
+
+	var songs []*LibrarySong
+	err = filepath.Walk(l.dir, func(name string, stat os.FileInfo, err error) error {
+		if err != nil {
+			problems = append(problems, err)
+			return nil
+		}
+		if stat.IsDir() || !isLibraryFile(name) {
+			return nil
+		}
+		relative, err := filepath.Rel(l.dir, name)
+		if err != nil {
+			return err
+		}
+		relative = filepath.ToSlash(relative)
+
+		if song := previous[relative]; song != nil && song.Size == stat.Size() && song.Modified.Equal(stat.ModTime()) {
+			songs = append(songs, song)
+			return nil
+		}
+		song, err := indexSong(name, relative, stat)
+		if err != nil {
+			problems = append(problems, err)
+			return nil
+		}
+		songs = append(songs, song)
+		return nil
+	})
+	if err != nil {
+		return problems, err
+	}
+
+	sort.Slice(songs, func(i, j int) bool {
+		a, b := songs[i], songs[j]
+		if artist_a, artist_b := strings.ToLower(a.Artist), strings.ToLower(b.Artist); artist_a != artist_b {
+			return artist_a < artist_b
+		}
+		return strings.ToLower(a.Title) < strings.ToLower(b.Title)
+	})
+	by_id := make(map[string]*LibrarySong, len(songs))
+	for _, song := range songs {
+		by_id[song.ID] = song
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.songs, l.by_id = songs, by_id
+	for id := range l.thumbnails {
+		if song := by_id[id]; song == nil || song != previous[song.Path] {
+			delete(l.thumbnails, id)
+		}
+	}
+	return problems, nil
+}
+
+func isLibraryFile(name string) bool {
+	for _, ext := range LIBRARY_EXTENSIONS {
+		if strings.EqualFold(filepath.Ext(name), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// indexSong reads the graphics of the song at name, and finds out whether it
+// has audio, without reading the audio itself.
+func indexSong(name, relative string, stat os.FileInfo) (*LibrarySong, error) {
+	song, err := loadSong(name, false)
+	if err != nil {
+		return nil, err
+	}
+	info := Inspect(name, song.CDG)
+
+	hash := sha1.Sum([]byte(relative))
+	indexed := &LibrarySong{
+		ID:          hex.EncodeToString(hash[:6]),
+		Path:        relative,
+		Duration:    info.Duration,
+		Channels:    []int{},
+		HasAudio:    song.HasAudio(),
+		AudioFormat: song.AudioFormat,
+		Size:        stat.Size(),
+		Modified:    stat.ModTime(),
+	}
+	// The name of a .zip is usually better kept than that of the .cdg inside.
+	indexed.Code, indexed.Artist, indexed.Title = ParseSongName(baseName(filepath.Base(name)))
+	for channel := range info.Channels {
+		indexed.Channels = append(indexed.Channels, channel)
+	}
+	sort.Ints(indexed.Channels)
+	return indexed, nil
+}
+
+// ParseSongName splits a song's file name, without its extension, into the
+// manufacturer code, artist and title, from the usual "CODE - Artist - Title"
+// or "Artist - Title". A name that doesn't follow either is all title.
+func ParseSongName(name string) (code, artist, title string) {
+	var parts []string
+	for _, part := range strings.Split(name, " - ") {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	if len(parts) >= 3 && looksLikeCode(parts[0]) {
+		code, parts = parts[0], parts[1:]
+	}
+	switch len(parts) {
+	case 0:
+		return code, "", strings.TrimSpace(name)
+	case 1:
+		return code, "", parts[0]
+	}
+	return code, parts[0], strings.Join(parts[1:], " - ")
+}
+
+// looksLikeCode reports whether part of a name is a manufacturer code like
+// SC8113-01 or SC-SBI-REMIX rather than an artist: one word, with a digit or
+// a hyphen in it.
+func looksLikeCode(part string) bool {
+	if strings.ContainsAny(part, " \t") {
+		return false
+	}
+	return strings.ContainsRune(part, '-') || strings.IndexFunc(part, unicode.IsDigit) >= 0
+}
+
+// Songs returns every song in the library, by artist and then title.
+func (l *Library) Songs() []*LibrarySong {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append([]*LibrarySong(nil), l.songs...)
+}
+
+// Song returns the song with id, or nil if there is none.
+func (l *Library) Song(id string) *LibrarySong {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.by_id[id]
+}
+
+// Search returns the songs matching every word of query, in the artist, title
+// or code, whose artist and title also contain artist and title. Matching
+// ignores case, and empty arguments match everything.
+func (l *Library) Search(query, artist, title string) []*LibrarySong {
+	words := strings.Fields(strings.ToLower(query))
+	artist, title = strings.ToLower(artist), strings.ToLower(title)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	found := []*LibrarySong{}
+	for _, song := range l.songs {
+		song_artist, song_title := strings.ToLower(song.Artist), strings.ToLower(song.Title)
+		if !strings.Contains(song_artist, artist) || !strings.Contains(song_title, title) {
+			continue
+		}
+		text := song_artist + " " + song_title + " " + strings.ToLower(song.Code)
+		matched := true
+		for _, word := range words {
+			if !strings.Contains(text, word) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			found = append(found, song)
+		}
+	}
+	return found
+}
+
+// Load loads the song with id, audio and all, for playing.
+func (l *Library) Load(id string) (*Song, error) {
+	song := l.Song(id)
+	if song == nil {
+		return nil, fmt.Errorf("no song %q in the library", id)
+	}
+	return LoadSong(filepath.Join(l.dir, filepath.FromSlash(song.Path)))
+}
+
+// Thumbnail returns a width x height PNG of the most telling frame from the
+// first 30 seconds of the song with id, as the thumbnail command picks it.
+func (l *Library) Thumbnail(id string, width, height int) ([]byte, error) {
+	song := l.Song(id)
+	if song == nil {
+		return nil, fmt.Errorf("no song %q in the library", id)
+	}
+	loaded, err := loadSong(filepath.Join(l.dir, filepath.FromSlash(song.Path)), false)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.RLock()
+	pack, picked := l.thumbnails[id]
+	l.mu.RUnlock()
+	if !picked {
+		pack, _ = PickThumbnail(loaded.CDG, 30*PACKS_PER_SECOND, PACKS_PER_SECOND/4)
+		l.mu.Lock()
+		l.thumbnails[id] = pack
+		l.mu.Unlock()
+	}
+
+	var png bytes.Buffer
+	if err := WriteThumbnail(&png, loaded.CDG, pack, width, height); err != nil {
+		return nil, err
+	}
+	return png.Bytes(), nil
+}
@@ -0,0 +1,211 @@
+package karaoke
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	DEFAULT_TARGET_LOUDNESS = -18.0 // LUFS songs are normalised to unless told otherwise, as ReplayGain 2.0 does.
+	TRUE_PEAK_CEILING       = -1.0  // dBTP normalisation never raises a song's true peak above.
+
+	loudness_block    = 4   // Gating blocks are 400ms, four 100ms steps.
+	loudness_absolute = -70 // LUFS below which a block is silence.
+	loudness_relative = -10 // LU below the ungated loudness at which a block is too quiet to count.
+	true_peak_phases  = 4   // Oversampling used to find the peaks between samples.
+	true_peak_taps    = 12  // Input samples each interpolated sample is made from.
+)
+
+// Loudness is the loudness of a song's audio as ITU-R BS.1770 and EBU R128
+// measure it, so that songs from different manufacturers can be played at the
+// same volume.
+type Loudness struct {
+	Integrated float64 `json:"integrated_lufs"` // Gated programme loudness, in LUFS.
+	TruePeak   float64 `json:"true_peak_dbtp"`  // Highest peak between the samples as well as at them, in dBTP.
+}
+
+// Gain returns the gain in dB that brings the song to target LUFS, held down
+// where needed to keep its true peak under TRUE_PEAK_CEILING.
+func (l *Loudness) Gain(target float64) float64 {
+	gain := target - l.Integrated
+	if ceiling := TRUE_PEAK_CEILING - l.TruePeak; gain > ceiling {
+		gain = ceiling
+	}
+	return gain
+}
+
+// biquad is a second order IIR filter for one channel.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	z1, z2             float64
+}
+
+func (f *biquad) filter(x float64) float64 {
+	y := f.b0*x + f.z1
+	f.z1 = f.b1*x - f.a1*y + f.z2
+	f.z2 = f.b2*x - f.a2*y
+	return y
+}
+
+// kWeighting returns the two stages of the BS.1770 K-weighting filter, a high
+// shelf for the head and a high pass, designed for rate rather than only the
+// 48 kHz the standard tabulates.
+func kWeighting(rate int) (shelf, high_pass biquad) {
+	k := math.Tan(math.Pi * 1681.974450955533 / float64(rate))
+	q := 0.7071752369554196
+	vh := math.Pow(10, 3.999843853973347/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf = biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	k = math.Tan(math.Pi * 38.13547087602444 / float64(rate))
+	q = 0.5003270373238773
+	a0 = 1 + k/q + k*k
+	high_pass = biquad{
+		b0: 1, b1: -2, b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+	return shelf, high_pass
+}
+
+// channelWeight is how much a channel counts towards the loudness: surround
+// channels of 5.1 count for more, the LFE not at all.
+func channelWeight(channel, channels int) float64 {
+	if channels == 6 {
+		switch channel {
+		case 3:
+			return 0
+		case 4, 5:
+			return 1.41
+		}
+	}
+	return 1
+}
+
+// truePeakFilter returns a windowed sinc interpolator with true_peak_phases
+// phases of true_peak_taps taps each, phase p being for the point p/phases of
+// the way between the middle two input samples.
+func truePeakFilter() [][]float64 {
+	phases := make([][]float64, true_peak_phases)
+	for p := range phases {
+		phases[p] = make([]float64, true_peak_taps)
+		for tap := range phases[p] {
+			t := float64(tap-true_peak_taps/2+1) - float64(p)/true_peak_phases
+			sinc := 1.0
+			if t != 0 {
+				sinc = math.Sin(math.Pi*t) / (math.Pi * t)
+			}
+			window := 0.5 + 0.5*math.Cos(math.Pi*t/(true_peak_taps/2))
+			phases[p][tap] = sinc * window
+		}
+	}
+	return phases
+}
+
+// MeasureLoudness decodes the whole of stream and measures its integrated
+// loudness and true peak.
+func MeasureLoudness(stream AudioStream) (*Loudness, error) {
+	if err := stream.SeekFrame(0); err != nil {
+		return nil, err
+	}
+	rate, channels := stream.SampleRate(), stream.Channels()
+	step := rate / 10
+
+	shelves, high_passes := make([]biquad, channels), make([]biquad, channels)
+	for c := range shelves {
+		shelves[c], high_passes[c] = kWeighting(rate)
+	}
+	phases := truePeakFilter()
+	history := make([][]float64, channels)
+	for c := range history {
+		history[c] = make([]float64, true_peak_taps)
+	}
+
+	// The weighted mean square of every 100ms step, four of which make a block.
+	var steps []float64
+	var sum float64
+	var peak float64
+	in_step := 0
+
+	buf := make([]float32, 4096*channels)
+	for {
+		n, err := stream.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for frame := 0; frame+channels <= n; frame += channels {
+			for c := 0; c < channels; c++ {
+				x := float64(buf[frame+c])
+				y := high_passes[c].filter(shelves[c].filter(x))
+				sum += channelWeight(c, channels) * y * y
+
+				h := history[c]
+				copy(h, h[1:])
+				h[len(h)-1] = x
+				for _, taps := range phases {
+					var v float64
+					for tap, coefficient := range taps {
+						v += h[tap] * coefficient
+					}
+					peak = math.Max(peak, math.Abs(v))
+				}
+			}
+			if in_step++; in_step == step {
+				steps = append(steps, sum/float64(step))
+				sum, in_step = 0, 0
+			}
+		}
+	}
+
+	var blocks []float64
+	for i := loudness_block; i <= len(steps); i++ {
+		var z float64
+		for _, s := range steps[i-loudness_block : i] {
+			z += s
+		}
+		blocks = append(blocks, z/loudness_block)
+	}
+
+	gated := func(threshold float64) (float64, int) {
+		var total float64
+		count := 0
+		for _, z := range blocks {
+			if lufs(z) > threshold {
+				total += z
+				count++
+			}
+		}
+		if count == 0 {
+			return 0, 0
+		}
+		return total / float64(count), count
+	}
+
+	ungated, count := gated(loudness_absolute)
+	if count == 0 {
+		return nil, fmt.Errorf("the audio is silent")
+	}
+	integrated, _ := gated(math.Max(loudness_absolute, lufs(ungated)+loudness_relative))
+
+	return &Loudness{
+		Integrated: math.Round(lufs(integrated)*100) / 100,
+		TruePeak:   math.Round(20*math.Log10(peak)*100) / 100,
+	}, nil
+}
+
+// lufs converts a weighted mean square to LUFS.
+func lufs(mean_square float64) float64 {
+	return -0.691 + 10*math.Log10(mean_square)
+}
@@ -0,0 +1,100 @@
+package karaoke
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// META_EXTENSION replaces the extension of a song's .cdg or .zip for the file
+// its metadata is kept in.
+const META_EXTENSION = ".k4g.json"
+
+// SongMeta is what is remembered about a song between runs, such as how far its
+// graphics are out of sync with its audio. It is kept as JSON next to the song,
+// so it travels with the files rather than with the machine.
+type SongMeta struct {
+	OffsetMs int       `json:"offset_ms,omitempty"` // How much later than the audio the graphics are shown, negative for earlier.
+	Loudness *Loudness `json:"loudness,omitempty"`  // The loudness of the audio, once it has been measured.
+
+	VocalReduction float64 `json:"vocal_reduction,omitempty"` // How strongly to cancel the vocals, 0 to 1, for tracks that aren't karaoke mixes.
+}
+
+// Offset is how much later than the audio the graphics of the song are shown.
+func (m *SongMeta) Offset() time.Duration {
+	return time.Duration(m.OffsetMs) * time.Millisecond
+}
+
+// SetOffset sets the offset of the graphics, rounded to the millisecond.
+func (m *SongMeta) SetOffset(offset time.Duration) {
+	m.OffsetMs = int(offset.Round(time.Millisecond) / time.Millisecond)
+}
+
+// MetaPath returns where the metadata of the song at song_path is kept.
+func MetaPath(song_path string) string {
+	return baseName(song_path) + META_EXTENSION
+}
+
+// LoadSongMeta reads the metadata of the song at song_path. A song that has none
+// yet gets the zero SongMeta.
+func LoadSongMeta(song_path string) (SongMeta, error) {
+	var meta SongMeta
+	data, err := ioutil.ReadFile(MetaPath(song_path))
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("%s: %v", MetaPath(song_path), err)
+	}
+	return meta, nil
+}
+
+// SaveSongMeta writes the metadata of the song at song_path, replacing the file
+// in one go so a crash can't leave half of it behind.
+func SaveSongMeta(song_path string, meta SongMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ReplaceFile(MetaPath(song_path), append(data, '\n'))
+}
+
+// ReplaceFile writes data to a temporary file next to name and renames it over
+// name, so name is always either all old or all new. The file keeps the mode it
+// had, a new one gets 0644.
+func ReplaceFile(name string, data []byte) error {
+	mode := os.FileMode(0644)
+	if stat, err := os.Stat(name); err == nil {
+		mode = stat.Mode().Perm()
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	// TempFile makes the file 0600, readable only by its owner.
+	if err := temp.Chmod(mode); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := os.Rename(temp.Name(), name); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return nil
+}
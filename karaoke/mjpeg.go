@@ -0,0 +1,128 @@
+package karaoke
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	MJPEG_BOUNDARY  = "karaoke4go-frame" // Separates the JPEGs of an MJPEG stream.
+	MJPEG_QUALITY   = 90                 // Default JPEG quality, high enough to keep the lyrics sharp.
+	MJPEG_KEEPALIVE = time.Second        // How often the frame is sent again while nothing changes.
+)
+
+// An MJPEGBroadcaster is a FrameSink that serves the frames as Motion JPEG, a
+// multipart/x-mixed-replace HTTP response of one JPEG after another, which TVs
+// and media boxes that can't run the HTML5 player can still show. Each viewer
+// picks a size. A frame is scaled and encoded once for every size being
+// watched, however many viewers watch it, and they are all sent it as soon as
+// it is ready, so they stay in step. A viewer too slow for the frame rate
+// skips to the latest frame.
+type MJPEGBroadcaster struct {
+	quality int
+
+	mu      sync.Mutex
+	frame   *image.RGBA                 // A copy of the latest frame.
+	changed chan struct{}               // Closed when frame is replaced.
+	jpegs   map[image.Point]*mjpegFrame // The latest frame, encoded at each size asked for.
+}
+
+type mjpegFrame struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// NewMJPEGBroadcaster returns an MJPEGBroadcaster encoding at quality, from 1
+// to 100, showing a black screen until the first frame.
+func NewMJPEGBroadcaster(quality int) *MJPEGBroadcaster {
+	return &MJPEGBroadcaster{
+		quality: quality,
+		frame:   image.NewRGBA(image.Rect(0, 0, VISIBLE_WIDTH, VISIBLE_HEIGHT)),
+		changed: make(chan struct{}),
+		jpegs:   make(map[image.Point]*mjpegFrame),
+	}
+}
+
+func (b *MJPEGBroadcaster) Frame(position Position, d *Decoder) error {
+	img := d.Image()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if bytes.Equal(b.frame.Pix, img.Pix) {
+		return nil
+	}
+	// The Decoder redraws into the same image, so it has to be copied.
+	b.frame = image.NewRGBA(img.Rect)
+	copy(b.frame.Pix, img.Pix)
+	b.jpegs = make(map[image.Point]*mjpegFrame)
+	close(b.changed)
+	b.changed = make(chan struct{})
+	return nil
+}
+
+// latest returns the latest frame as a width x height JPEG, and a channel that
+// is closed once there is a newer one. Whichever viewer asks first encodes it.
+func (b *MJPEGBroadcaster) latest(width, height int) ([]byte, <-chan struct{}, error) {
+	size := image.Pt(width, height)
+	b.mu.Lock()
+	frame, changed := b.frame, b.changed
+	encoded := b.jpegs[size]
+	if encoded == nil {
+		encoded = &mjpegFrame{}
+		b.jpegs[size] = encoded
+	}
+	b.mu.Unlock()
+
+	encoded.once.Do(func() {
+		scaled := frame
+		if !size.Eq(frame.Rect.Size()) {
+			scaled = ScaleNearest(frame, width, height)
+		}
+		var jpg bytes.Buffer
+		encoded.err = jpeg.Encode(&jpg, scaled, &jpeg.Options{Quality: b.quality})
+		encoded.data = jpg.Bytes()
+	})
+	return encoded.data, changed, encoded.err
+}
+
+// Stream serves the frames to one viewer as a width x height MJPEG stream,
+// starting with the frame on screen now, until done is closed or writing to
+// the viewer fails.
+func (b *MJPEGBroadcaster) Stream(w http.ResponseWriter, width, height int, done <-chan struct{}) error {
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+MJPEG_BOUNDARY)
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	flusher, _ := w.(http.Flusher)
+
+	for {
+		data, changed, err := b.latest(width, height)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", MJPEG_BOUNDARY, len(data)); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte("\r\n")); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		// Some viewers only show a frame once the next one starts, and some
+		// proxies drop a quiet connection, so a still screen is sent again.
+		select {
+		case <-done:
+			return nil
+		case <-changed:
+		case <-time.After(MJPEG_KEEPALIVE):
+		}
+	}
+}
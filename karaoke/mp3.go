@@ -0,0 +1,256 @@
+package karaoke
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/hajimehoshi/go-mp3"
+)
+
+// MP3_DECODER_DELAY is how many samples the MP3 synthesis filterbank lags
+// behind the encoder. The LAME encoder delay is counted from the input, so the
+// decoder delay is added on top of it when trimming.
+const MP3_DECODER_DELAY = 529
+
+// mp3_seek_preroll is how many frames are decoded and thrown away before a seek
+// target. A frame can take its data from the bit reservoir in the frames before
+// it, and the filterbank carries state across frames, so decoding from a cold
+// start is only exact after a few frames.
+const mp3_seek_preroll = 8
+
+// MP3Info is what the first frame of an MP3 says about the whole file. VBR files
+// start with a Xing or VBRI header frame, and CBR files from LAME with an Info
+// frame, holding the number of frames and, from LAME, how many samples of
+// encoder delay and padding to drop to get back exactly the original audio.
+type MP3Info struct {
+	Version         string `json:"version"` // "MPEG-1", "MPEG-2" or "MPEG-2.5", always Layer III. Only MPEG-1 and 2 can be decoded.
+	SampleRate      int    `json:"sample_rate"`
+	Channels        int    `json:"channels"`
+	SamplesPerFrame int    `json:"samples_per_frame"`
+	Header          string `json:"header,omitempty"` // "Xing", "Info", "VBRI" or empty.
+	Encoder         string `json:"encoder,omitempty"`
+	Frames          int64  `json:"frames"` // Audio frames after the header frame, 0 if unknown.
+	Bytes           int64  `json:"bytes"`
+	EncoderDelay    int    `json:"encoder_delay"`
+	Padding         int    `json:"padding"`
+}
+
+var mp3_sample_rates = [4][3]int{
+	{11025, 12000, 8000},  // MPEG-2.5
+	{},                    // reserved
+	{22050, 24000, 16000}, // MPEG-2
+	{44100, 48000, 32000}, // MPEG-1
+}
+
+var mp3_version_names = [4]string{"MPEG-2.5", "", "MPEG-2", "MPEG-1"}
+
+// skipID3v2 returns the offset just past an ID3v2 tag at the start of data.
+func skipID3v2(data []byte) int64 {
+	if len(data) < 10 || string(data[:3]) != "ID3" {
+		return 0
+	}
+	size := int64(data[6]&0x7F)<<21 | int64(data[7]&0x7F)<<14 | int64(data[8]&0x7F)<<7 | int64(data[9]&0x7F)
+	size += 10
+	if data[5]&0x10 != 0 { // A footer follows the tag.
+		size += 10
+	}
+	return size
+}
+
+// ParseMP3Info reads the first Layer III frame of an MP3 and any Xing, Info,
+// VBRI and LAME headers in it.
+func ParseMP3Info(data []byte) (*MP3Info, error) {
+	offset := skipID3v2(data)
+	for ; offset+4 <= int64(len(data)); offset++ {
+		header := binary.BigEndian.Uint32(data[offset:])
+		version, layer := header>>19&3, header>>17&3
+		bitrate, rate := header>>12&15, header>>10&3
+		if header&0xFFE00000 != 0xFFE00000 || version == 1 || layer != 1 || bitrate == 0 || bitrate == 15 || rate == 3 {
+			continue
+		}
+
+		info := &MP3Info{
+			Version:         mp3_version_names[version],
+			SampleRate:      mp3_sample_rates[version][rate],
+			Channels:        2,
+			SamplesPerFrame: 1152,
+		}
+		if header>>6&3 == 3 {
+			info.Channels = 1
+		}
+		if version != 3 {
+			info.SamplesPerFrame = 576
+		}
+
+		// The Xing header follows the side information, whose size depends
+		// on the version and the number of channels.
+		side_info := 32
+		switch {
+		case version == 3 && info.Channels == 1:
+			side_info = 17
+		case version != 3 && info.Channels == 2:
+			side_info = 17
+		case version != 3:
+			side_info = 9
+		}
+
+		frame := data[offset:]
+		if xing := 4 + side_info; len(frame) >= xing+8 && (string(frame[xing:xing+4]) == "Xing" || string(frame[xing:xing+4]) == "Info") {
+			parseXing(info, frame[xing:])
+		} else if len(frame) >= 36+26 && string(frame[36:40]) == "VBRI" {
+			info.Header = "VBRI"
+			info.Bytes = int64(binary.BigEndian.Uint32(frame[36+10:]))
+			info.Frames = int64(binary.BigEndian.Uint32(frame[36+14:]))
+		}
+		return info, nil
+	}
+	return nil, fmt.Errorf("mp3: no Layer III frame found")
+}
+
+// parseXing fills in info from a Xing or Info header and the LAME tag after it.
+func parseXing(info *MP3Info, xing []byte) {
+	info.Header = string(xing[:4])
+	flags := binary.BigEndian.Uint32(xing[4:])
+	field := 8
+	if flags&1 != 0 && len(xing) >= field+4 {
+		info.Frames = int64(binary.BigEndian.Uint32(xing[field:]))
+		field += 4
+	}
+	if flags&2 != 0 && len(xing) >= field+4 {
+		info.Bytes = int64(binary.BigEndian.Uint32(xing[field:]))
+		field += 4
+	}
+	if flags&4 != 0 {
+		field += 100 // The seek table, by percentage of the file.
+	}
+	if flags&8 != 0 {
+		field += 4
+	}
+
+	// The LAME tag: a 9 byte encoder version, 12 bytes of settings and
+	// replay gain, then 12 bits each of encoder delay and padding.
+	lame := xing[field:]
+	if len(lame) < 24 {
+		return
+	}
+	switch string(lame[:4]) {
+	case "LAME", "Lavc", "Lavf":
+		info.Encoder = string(bytes.TrimRight(lame[:9], "\x00 "))
+		info.EncoderDelay = int(lame[21])<<4 | int(lame[22])>>4
+		info.Padding = int(lame[22]&0x0F)<<8 | int(lame[23])
+	}
+}
+
+// mp3Stream decodes an MP3 as an AudioStream. The decoder always produces 16 bit
+// stereo, mono files included, and decodes the header frame as a frame of
+// silence, which is skipped along with the encoder and decoder delay so frame 0
+// is the first sample of the original audio.
+type mp3Stream struct {
+	decoder *mp3.Decoder
+	info    *MP3Info
+	skip    int64 // Decoded sample frames before the first real one.
+	length  int64
+	frame   int64
+	buf     []byte
+}
+
+// NewMP3Stream decodes MPEG-1 and 2 Layer III audio, CBR or VBR. Seeking
+// uses an index of every frame in the file, so it is exact to the sample frame
+// whatever the bitrate, and with a LAME tag so are the start and end. go-mp3
+// can't decode MPEG-2.5, the low sample rates of 8 to 12 kHz, so it is
+// refused before decoding starts.
+func NewMP3Stream(data []byte) (AudioStream, error) {
+	info, err := ParseMP3Info(data)
+	if err != nil {
+		return nil, err
+	}
+	if info.Version == "MPEG-2.5" {
+		return nil, fmt.Errorf("mp3: MPEG-2.5 (%d Hz) is not supported, only MPEG-1 and 2", info.SampleRate)
+	}
+	decoder, err := mp3.NewDecoder(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("mp3: %v", err)
+	}
+
+	s := &mp3Stream{decoder: decoder, info: info}
+	if info.Header != "" {
+		s.skip = int64(info.SamplesPerFrame)
+	}
+	if info.Encoder != "" {
+		s.skip += int64(info.EncoderDelay + MP3_DECODER_DELAY)
+	}
+
+	s.length = decoder.Length()/4 - s.skip
+	if info.Frames > 0 {
+		s.length = info.Frames*int64(info.SamplesPerFrame) - int64(info.EncoderDelay+info.Padding)
+	}
+	if decoded := decoder.Length()/4 - s.skip; decoded < s.length {
+		// A truncated file, the header promises more than is there.
+		s.length = decoded
+	}
+	if s.length < 0 {
+		s.length = 0
+	}
+	return s, s.SeekFrame(0)
+}
+
+func (s *mp3Stream) SampleRate() int { return s.info.SampleRate }
+func (s *mp3Stream) Channels() int   { return 2 }
+func (s *mp3Stream) Length() int64   { return s.length }
+
+func (s *mp3Stream) Read(samples []float32) (int, error) {
+	frames := int64(len(samples) / 2)
+	if left := s.length - s.frame; frames > left {
+		frames = left
+	}
+	if frames <= 0 {
+		return 0, io.EOF
+	}
+
+	if cap(s.buf) < int(frames)*4 {
+		s.buf = make([]byte, frames*4)
+	}
+	buf := s.buf[:frames*4]
+	n, err := io.ReadFull(s.decoder, buf)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	n -= n % 4
+	for i := 0; i < n/2; i++ {
+		samples[i] = float32(int16(binary.LittleEndian.Uint16(buf[i*2:]))) / 32768
+	}
+	s.frame += int64(n / 4)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n / 2, err
+}
+
+func (s *mp3Stream) SeekFrame(frame int64) error {
+	if frame < 0 {
+		frame = 0
+	}
+	if frame >= s.length {
+		s.frame = s.length
+		return nil
+	}
+
+	// Seek to the start of a frame well before the target and decode up to it.
+	target := frame + s.skip
+	samples_per_frame := int64(s.info.SamplesPerFrame)
+	start := (target/samples_per_frame - mp3_seek_preroll) * samples_per_frame
+	if start < 0 {
+		start = 0
+	}
+	if _, err := s.decoder.Seek(start*4, io.SeekStart); err != nil {
+		return fmt.Errorf("mp3: %v", err)
+	}
+	if _, err := io.CopyN(ioutil.Discard, s.decoder, (target-start)*4); err != nil {
+		return fmt.Errorf("mp3: %v", err)
+	}
+	s.frame = frame
+	return nil
+}
@@ -0,0 +1,101 @@
+package karaoke
+
+// CD+G packs are protected by two Reed-Solomon codes over GF(2^6), built from the
+// primitive polynomial x^6 + x + 1. The Q code covers symbols 0-3 (command,
+// instruction and two parity symbols) and the P code covers all 24 symbols, with
+// symbols 20-23 holding the parity.
+
+const gf64_primitive = 0x43 // x^6 + x + 1
+
+var (
+	gf64_exp = make([]byte, 126) // Antilog table, doubled so products never need a modulo.
+	gf64_log = make([]byte, 64)  // Log table, gf64_log[0] is unused.
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 63; i++ {
+		gf64_exp[i] = byte(x)
+		gf64_exp[i+63] = byte(x)
+		gf64_log[x] = byte(i)
+		x <<= 1
+		if x&0x40 != 0 {
+			x ^= gf64_primitive
+		}
+	}
+}
+
+func gf64Mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gf64_exp[int(gf64_log[a])+int(gf64_log[b])]
+}
+
+// rsSyndromesZero reports whether the 6 bit symbols form a valid codeword, that
+// is, whether the codeword polynomial has roots alpha^0 through alpha^(roots-1).
+func rsSyndromesZero(symbols []byte, roots int) bool {
+	for k := 0; k < roots; k++ {
+		alpha_k := gf64_exp[k]
+		syndrome := byte(0)
+		for _, s := range symbols {
+			syndrome = gf64Mul(syndrome, alpha_k) ^ (s & 0x3F)
+		}
+		if syndrome != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// packParityPresent reports whether any of the P or Q parity symbols are set.
+// Most rippers leave them zeroed, in which case there is nothing to check.
+func packParityPresent(cdg_pack []byte) bool {
+	return cdg_pack[2]&0x3F != 0 || cdg_pack[3]&0x3F != 0 ||
+		cdg_pack[20]&0x3F != 0 || cdg_pack[21]&0x3F != 0 ||
+		cdg_pack[22]&0x3F != 0 || cdg_pack[23]&0x3F != 0
+}
+
+// packQParityOK checks the Q parity of the command and instruction symbols.
+func packQParityOK(cdg_pack []byte) bool {
+	return rsSyndromesZero(cdg_pack[0:4], 2)
+}
+
+// packPParityOK checks the P parity of the whole pack.
+func packPParityOK(cdg_pack []byte) bool {
+	return rsSyndromesZero(cdg_pack[0:24], 4)
+}
+
+// rsParity computes the parity symbols for message so that message followed by
+// the parity is a valid codeword with roots alpha^0 through alpha^(len(parity)-1).
+func rsParity(message []byte, parity []byte) {
+	roots := len(parity)
+
+	// Generator polynomial (x + alpha^0)(x + alpha^1)..., highest power first.
+	generator := []byte{1}
+	for k := 0; k < roots; k++ {
+		next := make([]byte, len(generator)+1)
+		for idx, coeff := range generator {
+			next[idx] ^= coeff
+			next[idx+1] ^= gf64Mul(coeff, gf64_exp[k])
+		}
+		generator = next
+	}
+
+	for idx := range parity {
+		parity[idx] = 0
+	}
+	for _, s := range message {
+		feedback := (s & 0x3F) ^ parity[0]
+		for idx := 0; idx < roots-1; idx++ {
+			parity[idx] = parity[idx+1] ^ gf64Mul(feedback, generator[idx+1])
+		}
+		parity[roots-1] = gf64Mul(feedback, generator[roots])
+	}
+}
+
+// setPackParity fills in the Q and P parity symbols of a pack.
+func setPackParity(cdg_pack []byte) {
+	rsParity(cdg_pack[0:2], cdg_pack[2:4])
+	rsParity(cdg_pack[0:20], cdg_pack[20:24])
+}
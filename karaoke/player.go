@@ -0,0 +1,590 @@
+package karaoke
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_FRAME_RATE = 25                     // Frames a second a Player delivers unless told otherwise.
+	AUDIO_BUFFER       = 20 * time.Millisecond  // Audio written to the sink at a time.
+	AUDIO_LEAD         = 100 * time.Millisecond // How far the audio is written ahead of realtime.
+	GRAPHICS_FADE      = time.Second            // The least time the graphics take to fade out before the next song.
+)
+
+// PlayerState is whether a Player is stopped, playing or paused.
+type PlayerState int
+
+const (
+	PlayerStopped PlayerState = iota
+	PlayerPlaying
+	PlayerPaused
+)
+
+var player_state_names = []string{"stopped", "playing", "paused"}
+
+func (s PlayerState) String() string {
+	return player_state_names[s]
+}
+
+// A FrameSink receives the frames of a playing song. Frame is called on the
+// player's goroutine with the decoder already redrawn at position, so the sink
+// can read Image, Palette or VRAM, but must copy anything it keeps, and should
+// return quickly. An error stops playback.
+type FrameSink interface {
+	Frame(position Position, d *Decoder) error
+}
+
+// FrameSinkFunc lets an ordinary function be used as a FrameSink.
+type FrameSinkFunc func(position Position, d *Decoder) error
+
+func (f FrameSinkFunc) Frame(position Position, d *Decoder) error {
+	return f(position, d)
+}
+
+// A Player plays a song in realtime. Instead of decoding in a tight loop it asks
+// its Clock how far the song has got, decodes up to the matching pack, and hands
+// the frame to its sinks, frame rate times a second. With a SampleClock the
+// graphics follow the audio, the way the JS player follows the audio element's
+// currentTime; with a WallClock they play on their own. SetAudio makes the
+// Player play the audio as well, and follow the samples it has played.
+//
+// More songs can be queued with Enqueue. The audio of one song runs into the
+// next, crossfading if SetCrossfade asks for it, while the graphics fade to the
+// border color and the decoder is reset for the new song. SetBreakMusic plays
+// music between songs.
+//
+// All methods are safe to call from any goroutine.
+type Player struct {
+	mu         sync.Mutex
+	showing    *track // The song whose graphics are decoded, which catches up with playing on the next frame.
+	decoder    *Decoder
+	clock      Clock
+	frame_rate int
+	tempo      float64       // How many seconds of the song play per second of the clock.
+	latency    time.Duration // How much later the frames are seen than the audio is heard.
+	sinks      []FrameSink
+	state      PlayerState
+	err        error         // Why playback last stopped, if it wasn't asked to.
+	stop       chan struct{} // Closed to end the playback goroutine, nil if none is running.
+	done       chan struct{} // Closed once the playback goroutine has exited.
+
+	// Everything below is guarded by audio_mu, which is taken after mu.
+	audio_mu     sync.Mutex
+	playing      *track // The song being heard.
+	incoming     *track // The song being faded in, nil outside a crossfade.
+	faded        int64  // Sample frames of the crossfade played so far.
+	fade_frames  int64  // Sample frames the crossfade lasts.
+	queue        []Track
+	skip         bool    // Move on to the next song now.
+	pitch        float64 // Semitones the key of the songs is changed by.
+	volume       float32 // Of everything played, on top of each song's gain.
+	crossfade    time.Duration
+	break_music  AudioStream
+	break_length time.Duration
+	audio_sink   AudioSink
+	audio_clock  *SampleClock
+	rate         int // The format of the sink.
+	channels     int
+	mix_buf      []float32
+}
+
+// NewPlayer returns a stopped Player for cdg_file_data, timed by clock, or by a
+// WallClock if clock is nil.
+func NewPlayer(cdg_file_data []byte, clock Clock) *Player {
+	if clock == nil {
+		clock = NewWallClock()
+	}
+	first := &track{spec: Track{CDG: cdg_file_data}, cdg_file_data: cdg_file_data, gain: 1}
+	return &Player{
+		showing:    first,
+		playing:    first,
+		decoder:    NewDecoder(),
+		clock:      clock,
+		frame_rate: DEFAULT_FRAME_RATE,
+		tempo:      1,
+		volume:     1,
+	}
+}
+
+// Clock returns the clock the player follows.
+func (p *Player) Clock() Clock {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.clock
+}
+
+// SetAudio makes the player play stream to sink along with the graphics, and
+// replaces its clock with a SampleClock counting the samples written. The sink
+// is opened straight away, in the format of stream, and the songs queued after
+// this one are converted to it. It must be called while the player is stopped.
+func (p *Player) SetAudio(stream AudioStream, sink AudioSink) error {
+	if err := sink.Open(stream.SampleRate(), stream.Channels()); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.audio_mu.Lock()
+	defer p.audio_mu.Unlock()
+	p.audio_sink = sink
+	p.rate, p.channels = stream.SampleRate(), stream.Channels()
+	p.playing.pitch = p.pitch
+	p.playing.setAudio(stream, p.tempo)
+	p.audio_clock = NewSampleClock(stream.SampleRate())
+	p.clock = p.audio_clock
+	return nil
+}
+
+// SetTempo plays the songs speed times as fast, between MIN_TEMPO and
+// MAX_TEMPO. The graphics are decoded that much faster against the clock, and
+// the audio is time-stretched to match without changing its pitch. It can be
+// changed while playing; the song carries on from where it was.
+func (p *Player) SetTempo(speed float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rebuildAudio(func() {
+		p.tempo = math.Max(MIN_TEMPO, math.Min(MAX_TEMPO, speed))
+	})
+}
+
+// Tempo returns how many times as fast the songs are played.
+func (p *Player) Tempo() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.tempo
+}
+
+// SetPitch changes the key of the songs by semitones, up to MAX_PITCH_SHIFT
+// either way, as NewPitchShift does, on top of any change already made to
+// their audio. It can be changed while playing.
+func (p *Player) SetPitch(semitones float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rebuildAudio(func() {
+		p.pitch = math.Max(-MAX_PITCH_SHIFT, math.Min(MAX_PITCH_SHIFT, semitones))
+	})
+}
+
+// Pitch returns how many semitones the key of the songs is changed by.
+func (p *Player) Pitch() float64 {
+	p.audio_mu.Lock()
+	defer p.audio_mu.Unlock()
+	return p.pitch
+}
+
+// rebuildAudio makes a change to the tempo or key, with both locks held, and
+// rebuilds the audio of the song being heard to match, carrying on from the
+// same point in the song. p.mu must be held.
+func (p *Player) rebuildAudio(change func()) {
+	p.catchUp()
+	song_time := time.Duration(float64(p.clock.Elapsed()) * p.tempo)
+
+	p.audio_mu.Lock()
+	change()
+	in_song := !p.playing.is_break
+	if p.playing.source != nil && in_song {
+		p.playing.pitch = p.pitch
+		p.playing.setTempo(p.tempo)
+	}
+	p.audio_mu.Unlock()
+
+	// Break music has no tempo or key to keep to.
+	if in_song {
+		p.seekTo(song_time)
+	}
+}
+
+// SetVolume sets the volume of everything played, from 0 for silence to 1
+// for the songs as they are, on top of each song's gain. It can be changed
+// while playing.
+func (p *Player) SetVolume(volume float64) {
+	p.audio_mu.Lock()
+	defer p.audio_mu.Unlock()
+	p.volume = float32(math.Max(0, math.Min(1, volume)))
+}
+
+// Volume returns the volume of everything played, from 0 to 1.
+func (p *Player) Volume() float64 {
+	p.audio_mu.Lock()
+	defer p.audio_mu.Unlock()
+	return float64(p.volume)
+}
+
+// SetOffset shows the graphics of the current song offset later than the
+// audio, or earlier if it is negative, to make up for a song whose .cdg and
+// audio are out of sync. It can be changed while playing, to nudge the
+// graphics into place by eye.
+func (p *Player) SetOffset(offset time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.catchUp()
+	p.audio_mu.Lock()
+	defer p.audio_mu.Unlock()
+	p.playing.offset = offset
+}
+
+// SetLatency tells the player how long its outputs take to be seen and heard:
+// audio from being written to the sink to reaching the speakers, and video from
+// being handed to the frame sinks to being on screen. The graphics are decoded
+// ahead or behind by the difference, so they line up where they are watched
+// rather than where they leave the player. It can be changed while playing.
+func (p *Player) SetLatency(audio, video time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.latency = video - audio
+}
+
+// clockPosition is the position in the song the clock has reached, less the
+// offset of the graphics and allowing for the latency of the outputs. p.mu must
+// be held.
+func (p *Player) clockPosition() Position {
+	elapsed := time.Duration(float64(p.clock.Elapsed()+p.latency) * p.tempo)
+	return PositionOfDuration(elapsed - p.showing.offset)
+}
+
+// SetVocalReduction cancels the centre of the current song's audio by
+// strength, from 0 to 1, to take the lead vocal out of a song that isn't a
+// karaoke track, as NewVocalReduction does. It can be changed while playing.
+func (p *Player) SetVocalReduction(strength float64) {
+	p.audio_mu.Lock()
+	defer p.audio_mu.Unlock()
+	p.playing.spec.VocalReduction = strength
+	if p.playing.vocals != nil {
+		p.playing.vocals.setStrength(strength)
+	}
+}
+
+// SetGain changes the volume of the current song's audio by db decibels,
+// usually the gain from Loudness.Gain to bring it to a target loudness. It can
+// be changed while playing.
+func (p *Player) SetGain(db float64) {
+	p.audio_mu.Lock()
+	defer p.audio_mu.Unlock()
+	p.playing.gain = gainOf(db)
+}
+
+func gainOf(db float64) float32 {
+	return float32(math.Pow(10, db/20))
+}
+
+// SetFrameRate sets how many frames a second are delivered to the sinks. It
+// takes effect the next time playback starts.
+func (p *Player) SetFrameRate(fps int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if fps > 0 {
+		p.frame_rate = fps
+	}
+}
+
+// AddSink registers a sink for every frame from now on.
+func (p *Player) AddSink(sink FrameSink) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sinks = append(p.sinks, sink)
+}
+
+// State returns whether the player is stopped, playing or paused.
+func (p *Player) State() PlayerState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+// Position returns the pack the graphics have been decoded up to.
+func (p *Player) Position() Position {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.decoder.CurrentPack()
+}
+
+// Length returns how long the current song plays for.
+func (p *Player) Length() Position {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.showing.length()
+}
+
+// Play starts or resumes playback, from the top if the song had played to the end.
+func (p *Player) Play() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state == PlayerPlaying {
+		return
+	}
+	p.catchUp()
+	if p.state == PlayerStopped && p.clockPosition() >= p.showing.length() {
+		p.seek(0)
+	}
+	p.state = PlayerPlaying
+	p.clock.Start()
+	if p.stop == nil {
+		p.err = nil
+		p.stop, p.done = make(chan struct{}), make(chan struct{})
+		go p.run(p.frame_rate, p.stop, p.done)
+	}
+}
+
+// Pause holds playback at the current position. The frame stays on the sinks
+// until playback resumes or the player seeks.
+func (p *Player) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state != PlayerPlaying {
+		return
+	}
+	p.state = PlayerPaused
+	p.clock.Pause()
+}
+
+// Seek moves playback to position in the current song. Seeking backwards
+// re-decodes the song from the start, as a CD+G stream can only be decoded
+// forwards. A crossfade into the next song is called off, and the next song
+// put back at the front of the queue.
+func (p *Player) Seek(position Position) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.catchUp()
+	if position < 0 {
+		position = 0
+	}
+	if length := p.showing.length(); position > length {
+		position = length
+	}
+	p.seek(position)
+	if position < p.decoder.CurrentPack() {
+		p.decoder.Reset()
+	}
+}
+
+// seek moves the clock, and the audio with it, to position in the song. The
+// graphics follow, offset as usual.
+func (p *Player) seek(position Position) {
+	p.seekTo(position.Duration())
+}
+
+// seekTo is seek to song_time into the song, as measured on the audio before
+// the tempo change.
+func (p *Player) seekTo(song_time time.Duration) {
+	elapsed := time.Duration(float64(song_time) / p.tempo)
+	if p.audio_sink == nil {
+		p.clock.Seek(elapsed)
+		return
+	}
+
+	p.audio_mu.Lock()
+	defer p.audio_mu.Unlock()
+	p.cancelCrossfade()
+	frame := int64(elapsed * time.Duration(p.rate) / time.Second)
+	if err := p.playing.seek(frame); err != nil && p.err == nil {
+		p.err = err
+	}
+	p.clock.Seek(elapsed)
+}
+
+// Stop ends playback and rewinds to the start of the song. It returns once the
+// sinks have been handed their last frame.
+func (p *Player) Stop() {
+	p.mu.Lock()
+	stop, done := p.stop, p.done
+	p.stop = nil
+	p.state = PlayerStopped
+	p.clock.Pause()
+	p.catchUp()
+	p.seek(0)
+	p.decoder.Reset()
+	p.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Wait blocks until playback stops, whether at the end of the last song,
+// through Stop or because a sink failed, and returns the error if there was one.
+func (p *Player) Wait() error {
+	p.mu.Lock()
+	done := p.done
+	p.mu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Update decodes up to the clock's position and hands the frame to the sinks,
+// returning the position reached. Playback calls it on every frame, but it can
+// also be called directly to drive a player by hand, such as rendering from a
+// SampleClock faster than realtime.
+func (p *Player) Update() (Position, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.update()
+}
+
+func (p *Player) update() (Position, error) {
+	fade := p.catchUp()
+
+	target := p.clockPosition()
+	if target < 0 {
+		target = 0
+	}
+	if length := p.showing.length(); target > length {
+		target = length
+	}
+
+	current := p.decoder.CurrentPack()
+	if target < current {
+		// The clock went backwards behind our back, start again from the top.
+		p.decoder.Reset()
+	} else if target == current && p.state != PlayerPlaying {
+		return current, nil
+	}
+
+	p.decoder.DecodePacks(p.showing.cdg_file_data, target)
+	if fade > 0 {
+		// Show the frame faded towards the border, then put the real
+		// colors back for the packs still to come.
+		palette := append([]int(nil), p.decoder.Palette()...)
+		p.decoder.SetPalette(FadePalette(palette, p.decoder.BorderColor(), fade))
+		defer p.decoder.SetPalette(palette)
+	}
+	p.decoder.RedrawCanvas()
+	for _, sink := range p.sinks {
+		if err := sink.Frame(target, p.decoder); err != nil {
+			return target, err
+		}
+	}
+	return target, nil
+}
+
+// tick is one frame of playback, it returns false once the playback goroutine
+// started with stop should exit.
+func (p *Player) tick(stop chan struct{}) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != stop {
+		return false
+	}
+	if p.audio_sink == nil {
+		p.advanceGraphics()
+	}
+
+	position, err := p.update()
+	if err != nil {
+		p.fail(stop, err)
+		return false
+	}
+	ended := position >= p.showing.length()
+	p.audio_mu.Lock()
+	if p.audio_sink != nil {
+		ended = ended && p.playing.ended && p.incoming == nil && !p.hasNext()
+	} else {
+		ended = ended && len(p.queue) == 0
+	}
+	p.audio_mu.Unlock()
+	if p.state == PlayerPlaying && ended {
+		p.fail(stop, nil)
+		return false
+	}
+	return true
+}
+
+// fail stops the playback started with stop, recording err as the reason. p.mu
+// must be held.
+func (p *Player) fail(stop chan struct{}, err error) {
+	if p.stop != stop {
+		return
+	}
+	if p.err == nil {
+		p.err = err
+	}
+	p.stop = nil
+	p.state = PlayerStopped
+	p.clock.Pause()
+}
+
+func (p *Player) run(frame_rate int, stop, done chan struct{}) {
+	defer close(done)
+
+	if p.audio_sink != nil {
+		quit, audio_done := make(chan struct{}), make(chan struct{})
+		go p.runAudio(stop, quit, audio_done)
+		defer func() {
+			close(quit)
+			<-audio_done
+		}()
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(frame_rate))
+	defer ticker.Stop()
+
+	for p.tick(stop) {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runAudio writes the audio to the sink in realtime, keeping no more than
+// AUDIO_LEAD ahead of the wall clock, and advances the sample clock by every
+// sample frame written. Once the last song runs out it writes silence, as long
+// as the graphics are still playing.
+func (p *Player) runAudio(stop, quit, done chan struct{}) {
+	defer close(done)
+
+	rate, channels := p.rate, p.channels
+	buf := make([]float32, int(AUDIO_BUFFER*time.Duration(rate)/time.Second)*channels)
+	var started time.Time
+	var written int64
+
+	for {
+		wait := time.Duration(0)
+		if p.State() != PlayerPlaying {
+			started, wait = time.Time{}, AUDIO_BUFFER
+		} else if started.IsZero() {
+			started, written = time.Now(), 0
+		} else if ahead := time.Duration(written)*time.Second/time.Duration(rate) - time.Since(started); ahead > AUDIO_LEAD {
+			wait = ahead - AUDIO_LEAD
+		}
+		if wait > 0 {
+			select {
+			case <-stop:
+				return
+			case <-quit:
+				return
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		p.audio_mu.Lock()
+		err := p.fill(buf)
+		if err == nil {
+			if p.volume != 1 {
+				for i := range buf {
+					buf[i] *= p.volume
+				}
+			}
+			err = p.audio_sink.Write(buf)
+			p.audio_clock.Advance(len(buf) / channels)
+		}
+		p.audio_mu.Unlock()
+
+		if err != nil {
+			p.mu.Lock()
+			p.fail(stop, err)
+			p.mu.Unlock()
+			return
+		}
+		written += int64(len(buf) / channels)
+	}
+}
@@ -0,0 +1,160 @@
+package karaoke
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SECTORS_PER_SECOND = 75  // CD frames (sectors) per second, the F in MSF.
+	MSF_LEAD_IN        = 150 // Absolute MSF 00:02:00 is sector 0, after the 2 second pregap.
+)
+
+// A Position is a point in a CD+G stream, counted in packs from the start. It is
+// the unit DecodePacks works in: 300 packs a second, 4 per CD sector.
+type Position int
+
+// PositionOfDuration returns the position reached after d, rounded down to a whole pack.
+func PositionOfDuration(d time.Duration) Position {
+	return Position(d * PACKS_PER_SECOND / time.Second)
+}
+
+// PositionOfSector returns the position of the first pack of a sector.
+func PositionOfSector(sector int) Position {
+	return Position(sector * PACKS_PER_SECTOR)
+}
+
+// PositionOfMSF returns the position of the first pack of a relative MSF address.
+func PositionOfMSF(msf MSF) Position {
+	return PositionOfSector(msf.Sectors())
+}
+
+// Duration returns the playback time at p.
+func (p Position) Duration() time.Duration {
+	return time.Duration(p) * time.Second / PACKS_PER_SECOND
+}
+
+// Seconds returns the playback time at p in seconds.
+func (p Position) Seconds() float64 {
+	return float64(p) / PACKS_PER_SECOND
+}
+
+// Sector returns the sector p falls in.
+func (p Position) Sector() int {
+	return int(p) / PACKS_PER_SECTOR
+}
+
+// MSF returns the sector p falls in as a relative minutes:seconds:frames address.
+func (p Position) MSF() MSF {
+	return MSFOfSectors(p.Sector())
+}
+
+// String formats p as minutes and seconds, such as 3:05.250.
+func (p Position) String() string {
+	sign := ""
+	if p < 0 {
+		sign, p = "-", -p
+	}
+	millis := int64(p.Duration() / time.Millisecond)
+	return fmt.Sprintf("%s%d:%02d.%03d", sign, millis/60000, millis/1000%60, millis%1000)
+}
+
+// An MSF is a CD address in minutes, seconds and frames (sectors), 75 frames a second.
+type MSF struct {
+	M, S, F int
+}
+
+// MSFOfSectors splits a sector count into minutes, seconds and frames.
+func MSFOfSectors(sectors int) MSF {
+	return MSF{sectors / (60 * SECTORS_PER_SECOND), sectors / SECTORS_PER_SECOND % 60, sectors % SECTORS_PER_SECOND}
+}
+
+// Sectors returns the number of sectors the address counts.
+func (m MSF) Sectors() int {
+	return (m.M*60+m.S)*SECTORS_PER_SECOND + m.F
+}
+
+// LBA returns the logical block address of an absolute MSF address, which
+// counts from the end of the 2 second pregap.
+func (m MSF) LBA() int {
+	return m.Sectors() - MSF_LEAD_IN
+}
+
+func (m MSF) String() string {
+	return fmt.Sprintf("%02d:%02d:%02d", m.M, m.S, m.F)
+}
+
+// ParseMSF parses an mm:ss:ff address.
+func ParseMSF(value string) (MSF, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return MSF{}, fmt.Errorf("bad MSF address %q, want mm:ss:ff", value)
+	}
+	var fields [3]int
+	for idx, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || strings.HasPrefix(part, "-") {
+			return MSF{}, fmt.Errorf("bad MSF address %q, want mm:ss:ff", value)
+		}
+		fields[idx] = n
+	}
+	if fields[1] >= 60 || fields[2] >= SECTORS_PER_SECOND {
+		return MSF{}, fmt.Errorf("bad MSF address %q, seconds must be below 60 and frames below 75", value)
+	}
+	return MSF{fields[0], fields[1], fields[2]}, nil
+}
+
+// ParsePosition parses the ways a position can be written:
+//
+//	90.5, 1:30.5, 1m30.5s   seconds, minutes:seconds or a Go duration
+//	01:30:37, msf:01:30:37  a relative CD address, minutes:seconds:frames
+//	sector:6787             a CD sector
+//	pack:27150              a pack index, as used by DecodePacks
+//
+// None of them may be negative.
+func ParsePosition(value string) (Position, error) {
+	switch {
+	case strings.HasPrefix(value, "pack:"):
+		n, err := strconv.Atoi(strings.TrimPrefix(value, "pack:"))
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("bad pack position %q", value)
+		}
+		return Position(n), nil
+
+	case strings.HasPrefix(value, "sector:"):
+		n, err := strconv.Atoi(strings.TrimPrefix(value, "sector:"))
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("bad sector position %q", value)
+		}
+		return PositionOfSector(n), nil
+
+	case strings.HasPrefix(value, "msf:") || strings.Count(value, ":") == 2:
+		msf, err := ParseMSF(strings.TrimPrefix(value, "msf:"))
+		if err != nil {
+			return 0, err
+		}
+		return PositionOfMSF(msf), nil
+	}
+
+	if d, err := time.ParseDuration(value); err == nil {
+		if d < 0 {
+			return 0, fmt.Errorf("bad position %q, it is before the start", value)
+		}
+		return PositionOfDuration(d), nil
+	}
+
+	seconds := 0.0
+	for _, part := range strings.Split(value, ":") {
+		n, err := strconv.ParseFloat(part, 64)
+		// Signbit also catches -0, so -0:05 isn't taken for 0:05.
+		if err != nil || math.Signbit(n) || math.IsNaN(n) || math.IsInf(n, 0) {
+			return 0, fmt.Errorf("bad position %q, want seconds, mm:ss, a duration such as 1m30s, mm:ss:ff, sector:N or pack:N", value)
+		}
+		seconds = seconds*60 + n
+	}
+	// The epsilon keeps 4.35 seconds from landing a hair short of pack 1305.
+	return Position(seconds*PACKS_PER_SECOND + 1e-6), nil
+}
@@ -0,0 +1,64 @@
+package karaoke
+
+import "testing"
+
+func TestParsePosition(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Position
+		ok    bool
+	}{
+		// Seconds, minutes:seconds and Go durations.
+		{"0", 0, true},
+		{"90.5", 27150, true},
+		{"4.35", 1305, true},
+		{"1:30.5", 27150, true},
+		{"1:02:30.5", 0, false}, // Two colons make it an MSF address, which has no fractions.
+		{"1m30.5s", 27150, true},
+		{"250ms", 75, true},
+
+		// CD addresses, sectors and packs.
+		{"01:30:37", PositionOfSector(90*SECTORS_PER_SECOND + 37), true},
+		{"msf:01:30:37", PositionOfSector(90*SECTORS_PER_SECOND + 37), true},
+		{"msf:00:00:00", 0, true},
+		{"sector:6787", 27148, true},
+		{"pack:27150", 27150, true},
+
+		// Negative positions.
+		{"-5", 0, false},
+		{"-5s", 0, false},
+		{"-0:05", 0, false},
+		{"-1:30.5", 0, false},
+		{"msf:-00:01:00", 0, false},
+		{"-00:01:00", 0, false},
+		{"sector:-1", 0, false},
+		{"pack:-300", 0, false},
+
+		// Garbage.
+		{"", 0, false},
+		{"abc", 0, false},
+		{"1:xx", 0, false},
+		{"NaN", 0, false},
+		{"Inf", 0, false},
+		{"pack:", 0, false},
+		{"pack:1.5", 0, false},
+		{"sector:abc", 0, false},
+		{"msf:01:30", 0, false},
+		{"01:60:00", 0, false},
+		{"01:00:75", 0, false},
+	}
+	for _, test := range tests {
+		got, err := ParsePosition(test.value)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("ParsePosition(%q) = %d, want an error", test.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParsePosition(%q): %v", test.value, err)
+		} else if got != test.want {
+			t.Errorf("ParsePosition(%q) = %d, want %d", test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package karaoke
+
+import (
+	"io"
+	"math"
+	"time"
+)
+
+// A Track is a song queued on a Player, with the settings it is played with.
+type Track struct {
+	Name           string
+	CDG            []byte
+	Audio          AudioStream   // Nil to play silence for as long as the graphics.
+	Offset         time.Duration // As Player.SetOffset.
+	Gain           float64       // Decibels, as Player.SetGain.
+	VocalReduction float64       // As Player.SetVocalReduction.
+}
+
+// track is a Track as it is played: its audio converted to the format of the
+// sink and stretched to the tempo, and how far it has got.
+type track struct {
+	spec          Track
+	cdg_file_data []byte
+	offset        time.Duration
+	source        AudioStream   // The audio in the format of the sink, before the tempo change.
+	vocals        *vocalReducer // Between the audio and source, nil unless it is stereo.
+	audio         AudioStream   // The audio as played, at the tempo and in the key.
+	tempo         float64
+	pitch         float64 // Semitones, as Player.SetPitch.
+	rate          int
+	gain          float32
+	played        int64 // Sample frames read so far, including the silence after the audio.
+	audio_end     int64 // Where the audio runs out, -1 until that is known.
+	audio_eof     bool
+	ended         bool // Both the audio and the graphics have finished.
+	is_break      bool // Break music between songs, which has no graphics and never ends.
+}
+
+// length is how long the graphics of the track play for.
+func (t *track) length() Position {
+	return Position(len(t.cdg_file_data) / PACK_SIZE)
+}
+
+func (t *track) setAudio(stream AudioStream, tempo float64) {
+	t.source, t.vocals = stream, nil
+	if stream.Channels() == 2 && !t.is_break {
+		t.vocals = newVocalReducer(stream, t.spec.VocalReduction)
+		t.source = t.vocals
+	}
+	t.rate = stream.SampleRate()
+	t.setTempo(tempo)
+}
+
+// setTempo rebuilds the audio at tempo, in the key of t.pitch. It has to be
+// seeked to where it is to be played from.
+func (t *track) setTempo(tempo float64) {
+	t.tempo = tempo
+	t.audio = NewTempo(NewPitchShift(t.source, t.pitch), tempo)
+	t.audio_end, t.audio_eof = t.audio.Length(), false
+}
+
+// seek moves the audio to sample frame, at the tempo.
+func (t *track) seek(frame int64) error {
+	t.played, t.ended = frame, false
+	t.audio_end, t.audio_eof = t.audio.Length(), false
+	return t.audio.SeekFrame(frame)
+}
+
+// frames is how many sample frames the track lasts, the longer of the audio
+// and the graphics, or -1 if that isn't known yet.
+func (t *track) frames() int64 {
+	if t.is_break || t.audio_end < 0 {
+		return -1
+	}
+	graphics := (t.length().Duration() + t.offset).Seconds() / t.tempo * float64(t.rate)
+	return int64(math.Max(float64(t.audio_end), graphics))
+}
+
+// remaining is how many sample frames of the track are left, or -1 if that
+// isn't known.
+func (t *track) remaining() int64 {
+	frames := t.frames()
+	if frames < 0 {
+		return -1
+	}
+	if frames < t.played {
+		return 0
+	}
+	return frames - t.played
+}
+
+// read fills samples with the next of the track's audio, and with silence
+// once the audio has run out.
+func (t *track) read(samples []float32) error {
+	channels := t.audio.Channels()
+	n := 0
+	for n < len(samples) && !t.audio_eof {
+		read, err := t.audio.Read(samples[n:])
+		n += read
+		if err == io.EOF {
+			t.audio_eof = true
+			t.audio_end = t.played + int64(n/channels)
+		} else if err != nil {
+			return err
+		}
+	}
+	for i := n; i < len(samples); i++ {
+		samples[i] = 0
+	}
+	if t.gain != 1 {
+		for i := range samples[:n] {
+			samples[i] *= t.gain
+		}
+	}
+
+	t.played += int64(len(samples) / channels)
+	if frames := t.frames(); frames >= 0 && t.played >= frames {
+		t.ended = true
+	}
+	return nil
+}
+
+// Enqueue adds a song to the end of the queue, to be played after the current
+// song and those already queued.
+func (p *Player) Enqueue(song Track) {
+	p.audio_mu.Lock()
+	defer p.audio_mu.Unlock()
+	p.queue = append(p.queue, song)
+}
+
+// Queue returns the songs still to be played after the current one.
+func (p *Player) Queue() []Track {
+	p.audio_mu.Lock()
+	defer p.audio_mu.Unlock()
+	return append([]Track(nil), p.queue...)
+}
+
+// Current returns the song being heard, the zero Track during break music.
+func (p *Player) Current() Track {
+	p.audio_mu.Lock()
+	defer p.audio_mu.Unlock()
+	if p.playing.is_break {
+		return Track{}
+	}
+	return p.playing.spec
+}
+
+// SetName names the song playing now. It is for the song the player was made
+// with, which has no Track to take a name from.
+func (p *Player) SetName(name string) {
+	p.audio_mu.Lock()
+	defer p.audio_mu.Unlock()
+	p.playing.spec.Name = name
+}
+
+// InBreak reports whether break music is playing between songs.
+func (p *Player) InBreak() bool {
+	p.audio_mu.Lock()
+	defer p.audio_mu.Unlock()
+	return p.playing.is_break
+}
+
+// Next moves on to the next song in the queue, crossfading into it as it
+// would at the end of the song. It does nothing if there is nothing to move
+// on to.
+func (p *Player) Next() {
+	p.audio_mu.Lock()
+	defer p.audio_mu.Unlock()
+	p.skip = true
+}
+
+// SetCrossfade makes each song fade into the next over length, rather than the
+// next starting once the last has finished. It can be changed while playing.
+func (p *Player) SetCrossfade(length time.Duration) {
+	p.audio_mu.Lock()
+	defer p.audio_mu.Unlock()
+	if length < 0 {
+		length = 0
+	}
+	p.crossfade = length
+}
+
+// SetBreakMusic plays music, over and over, between songs: for length between
+// each pair, or if length is 0 only once the queue runs out, until another
+// song is queued. Break music carries on from where it left off each time. A
+// nil music stops break music. It only plays with the audio from SetAudio.
+func (p *Player) SetBreakMusic(music AudioStream, length time.Duration) {
+	p.audio_mu.Lock()
+	defer p.audio_mu.Unlock()
+	p.break_music, p.break_length = music, length
+}
+
+// framesOf converts a duration to sample frames of the sink. p.audio_mu must
+// be held.
+func (p *Player) framesOf(d time.Duration) int64 {
+	return int64(d) * int64(p.rate) / int64(time.Second)
+}
+
+// hasNext reports whether there is anything to play after the current track.
+// p.audio_mu must be held.
+func (p *Player) hasNext() bool {
+	return len(p.queue) > 0 || (p.break_music != nil && p.audio_sink != nil && !p.playing.is_break)
+}
+
+// nextTrack takes what plays after the current track off the queue: break
+// music if there is any to play, otherwise the next song. p.audio_mu must be
+// held.
+func (p *Player) nextTrack() (*track, error) {
+	if p.break_music != nil && !p.playing.is_break && (p.break_length > 0 || len(p.queue) == 0) {
+		t := &track{gain: 1, is_break: true}
+		t.setAudio(&looped{NewConversion(p.break_music, p.rate, p.channels)}, 1)
+		return t, nil
+	}
+
+	spec := p.queue[0]
+	p.queue = p.queue[1:]
+	t := &track{spec: spec, cdg_file_data: spec.CDG, offset: spec.Offset, gain: gainOf(spec.Gain), pitch: p.pitch}
+	stream := spec.Audio
+	if stream == nil {
+		stream = NewSilence(p.rate, p.channels, FramesOfPosition(t.length(), p.rate))
+	} else if err := stream.SeekFrame(0); err != nil {
+		return nil, err
+	}
+	t.setAudio(NewConversion(stream, p.rate, p.channels), p.tempo)
+	return t, nil
+}
+
+// toNext is how many sample frames are left before the next track takes
+// over, or -1 if there is no telling. p.audio_mu must be held.
+func (p *Player) toNext() int64 {
+	switch {
+	case p.incoming != nil:
+		return p.fade_frames - p.faded
+	case !p.hasNext():
+		return -1
+	case p.playing.is_break:
+		return int64(math.Max(0, float64(p.framesOf(p.break_length)-p.playing.played)))
+	}
+	return p.playing.remaining()
+}
+
+// due is how many sample frames are left before transition has something to
+// do, or -1 if there is no telling. p.audio_mu must be held.
+func (p *Player) due() int64 {
+	to_next := p.toNext()
+	if p.incoming != nil || p.playing.is_break || to_next < 0 {
+		return to_next
+	}
+	return int64(math.Max(0, float64(to_next-p.framesOf(p.crossfade))))
+}
+
+// transition starts a crossfade into the next track once the current one is
+// close enough to its end, and hands over to it once the crossfade is done.
+// p.audio_mu must be held.
+func (p *Player) transition() error {
+	if p.incoming != nil {
+		if p.faded >= p.fade_frames || p.playing.ended {
+			p.handOff()
+		}
+		return nil
+	}
+	if !p.hasNext() {
+		p.skip = false
+		return nil
+	}
+
+	fade := p.framesOf(p.crossfade)
+	if due := p.due(); p.playing.ended {
+		fade = 0
+	} else if !p.skip && due != 0 {
+		return nil
+	} else if !p.skip && !p.playing.is_break {
+		fade = p.playing.remaining()
+	}
+
+	next, err := p.nextTrack()
+	if err != nil {
+		return err
+	}
+	p.skip = false
+	p.incoming, p.faded, p.fade_frames = next, 0, fade
+	if fade <= 0 {
+		p.handOff()
+	}
+	return nil
+}
+
+// handOff makes the incoming track the one being played, and moves the clock
+// to where it has got to. p.audio_mu must be held.
+func (p *Player) handOff() {
+	p.playing, p.incoming = p.incoming, nil
+	p.faded, p.fade_frames = 0, 0
+	p.audio_clock.Seek(time.Duration(p.playing.played) * time.Second / time.Duration(p.rate))
+}
+
+// cancelCrossfade calls off a crossfade, putting the song that was fading in
+// back at the front of the queue. p.audio_mu must be held.
+func (p *Player) cancelCrossfade() {
+	p.skip = false
+	if p.incoming == nil {
+		return
+	}
+	if !p.incoming.is_break {
+		p.queue = append([]Track{p.incoming.spec}, p.queue...)
+	}
+	p.incoming, p.faded, p.fade_frames = nil, 0, 0
+}
+
+// fill reads the next of the audio into samples, mixing the incoming track in
+// during a crossfade. It is read in chunks that end where a transition is due,
+// so that each starts on time. p.audio_mu must be held.
+func (p *Player) fill(samples []float32) error {
+	channels := p.channels
+	for len(samples) > 0 {
+		if err := p.transition(); err != nil {
+			return err
+		}
+
+		frames := int64(len(samples) / channels)
+		if due := p.due(); due > 0 && due < frames {
+			frames = due
+		}
+		chunk := samples[:frames*int64(channels)]
+		samples = samples[len(chunk):]
+
+		if err := p.playing.read(chunk); err != nil {
+			return err
+		}
+		if p.incoming == nil {
+			continue
+		}
+
+		if cap(p.mix_buf) < len(chunk) {
+			p.mix_buf = make([]float32, len(chunk))
+		}
+		incoming := p.mix_buf[:len(chunk)]
+		if err := p.incoming.read(incoming); err != nil {
+			return err
+		}
+		// Equal power, so the loudness holds steady through the fade.
+		for frame := int64(0); frame < frames; frame++ {
+			x := (float64(p.faded+frame) + 0.5) / float64(p.fade_frames) * math.Pi / 2
+			out, in := float32(math.Cos(x)), float32(math.Sin(x))
+			for c := int64(0); c < int64(channels); c++ {
+				i := frame*int64(channels) + c
+				chunk[i] = chunk[i]*out + incoming[i]*in
+			}
+		}
+		p.faded += frames
+	}
+	return nil
+}
+
+// catchUp moves the graphics on to the track being heard, resetting the
+// decoder for it, and returns how far they should be faded towards the border
+// color, from 0 to 1, as the next track draws near. p.mu must be held.
+func (p *Player) catchUp() float64 {
+	p.audio_mu.Lock()
+	defer p.audio_mu.Unlock()
+	if p.showing != p.playing {
+		p.showing = p.playing
+		p.decoder.Reset()
+	}
+
+	var left time.Duration
+	if p.audio_sink != nil {
+		to_next := p.toNext()
+		if to_next < 0 {
+			return 0
+		}
+		left = time.Duration(to_next) * time.Second / time.Duration(p.rate)
+	} else {
+		if len(p.queue) == 0 {
+			return 0
+		}
+		left = time.Duration(float64((p.showing.length() - p.clockPosition()).Duration()) / p.tempo)
+	}
+
+	window := p.crossfade
+	if window < GRAPHICS_FADE {
+		window = GRAPHICS_FADE
+	}
+	return math.Max(0, math.Min(1, 1-float64(left)/float64(window)))
+}
+
+// advanceGraphics moves on to the next song in the queue once the graphics of
+// the current one have finished, for a player with no audio. p.mu must be held.
+func (p *Player) advanceGraphics() {
+	p.audio_mu.Lock()
+	defer p.audio_mu.Unlock()
+	if len(p.queue) == 0 {
+		p.skip = false
+		return
+	}
+	if !p.skip && p.clockPosition() < p.showing.length() {
+		return
+	}
+
+	spec := p.queue[0]
+	p.queue = p.queue[1:]
+	next := &track{spec: spec, cdg_file_data: spec.CDG, offset: spec.Offset, gain: gainOf(spec.Gain)}
+	p.showing, p.playing, p.skip = next, next, false
+	p.clock.Seek(0)
+	p.decoder.Reset()
+}
@@ -0,0 +1,75 @@
+package karaoke
+
+import (
+	"fmt"
+	"time"
+)
+
+// REMOTE_STATE_INTERVAL is how often a remote control is sent the state of
+// the player, if it has changed.
+const REMOTE_STATE_INTERVAL = 500 * time.Millisecond
+
+// A RemoteCommand is what a remote control sends to a Player, as JSON.
+type RemoteCommand struct {
+	Command string  `json:"command"` // play, pause, skip, restart, seek, key, tempo or volume.
+	Value   float64 `json:"value"`   // For seek, the second of the song; key, semitones; tempo, the speed; volume, 0 to 1.
+}
+
+// Apply carries out the command on p.
+func (c *RemoteCommand) Apply(p *Player) error {
+	switch c.Command {
+	case "play":
+		p.Play()
+	case "pause":
+		p.Pause()
+	case "skip":
+		p.Next()
+	case "restart":
+		p.Seek(0)
+	case "seek":
+		p.Seek(PositionOfDuration(time.Duration(c.Value * float64(time.Second))))
+	case "key":
+		p.SetPitch(c.Value)
+	case "tempo":
+		p.SetTempo(c.Value)
+	case "volume":
+		p.SetVolume(c.Value)
+	default:
+		return fmt.Errorf("unknown command %q", c.Command)
+	}
+	return nil
+}
+
+// RemoteState is what a remote control is sent of a Player, as JSON.
+type RemoteState struct {
+	Type     string   `json:"type"`     // Always "state", to tell it from an "error".
+	State    string   `json:"state"`    // stopped, playing or paused.
+	Song     string   `json:"song"`     // Empty during break music.
+	Break    bool     `json:"break"`    // Break music is playing.
+	Position float64  `json:"position"` // Seconds into the song.
+	Length   float64  `json:"length"`   // Seconds.
+	Key      float64  `json:"key"`      // Semitones.
+	Tempo    float64  `json:"tempo"`
+	Volume   float64  `json:"volume"`
+	Queue    []string `json:"queue"` // The names of the songs still to play.
+}
+
+// NewRemoteState returns the state of p now.
+func NewRemoteState(p *Player) *RemoteState {
+	state := &RemoteState{
+		Type:     "state",
+		State:    p.State().String(),
+		Song:     p.Current().Name,
+		Break:    p.InBreak(),
+		Position: p.Position().Seconds(),
+		Length:   p.Length().Seconds(),
+		Key:      p.Pitch(),
+		Tempo:    p.Tempo(),
+		Volume:   p.Volume(),
+		Queue:    []string{},
+	}
+	for _, track := range p.Queue() {
+		state.Queue = append(state.Queue, track.Name)
+	}
+	return state
+}
@@ -0,0 +1,393 @@
+package karaoke
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotInRotation is returned for a singer or request the rotation doesn't have.
+var ErrNotInRotation = errors.New("no such singer or request in the rotation")
+
+// A Singer is someone in the rotation, with the songs they have asked to sing.
+type Singer struct {
+	ID       string         `json:"id"`
+	Name     string         `json:"name"`
+	Present  bool           `json:"present"` // Singers who have stepped out are skipped until they are back.
+	Requests []*SongRequest `json:"requests"`
+	Sung     int            `json:"sung"` // Songs sung so far.
+}
+
+// A SongRequest is a song a singer has asked for.
+type SongRequest struct {
+	ID     string    `json:"id"`
+	SongID string    `json:"song_id"` // The LibrarySong.
+	Title  string    `json:"title"`   // How the song is shown, such as "Artist - Title".
+	Added  time.Time `json:"added"`
+}
+
+// A RotationEntry is one turn at the microphone: a singer and their song.
+type RotationEntry struct {
+	SingerID string       `json:"singer_id"`
+	Name     string       `json:"name"`
+	Request  *SongRequest `json:"request"`
+	Round    int          `json:"round"`
+}
+
+// RotationState is everything about a rotation, as it is saved and as it is
+// sent to anyone watching.
+type RotationState struct {
+	Singers     []*Singer `json:"singers"`       // In rotation order.
+	Up          int       `json:"up"`            // The singer whose turn it is.
+	TurnSongs   int       `json:"turn_songs"`    // Songs the singer who is up has sung this turn.
+	Round       int       `json:"round"`         // Passes through the rotation so far, from 1.
+	MaxPerRound int       `json:"max_per_round"` // Songs a singer may sing in a row each round.
+
+	Current  *RotationEntry  `json:"current,omitempty"`  // What is being sung now.
+	Upcoming []RotationEntry `json:"upcoming,omitempty"` // Who sings next, in order, when the state is sent rather than saved.
+}
+
+// A Rotation runs the singers of a karaoke night in a fair order: round robin,
+// each singer singing up to MaxPerRound of their requests on their turn, and
+// anyone absent or without requests skipped without losing their place. Every
+// change is saved, so a restarted server carries on where it was, and sent to
+// the subscribers. All methods are safe to call from any goroutine.
+type Rotation struct {
+	mu          sync.Mutex
+	path        string // Where the state is saved, "" to keep it in memory.
+	state       RotationState
+	subscribers map[chan *RotationState]bool
+}
+
+// NewRotation loads the rotation saved at path, or starts an empty one if
+// there is no file there yet. An empty path keeps the rotation in memory only.
+func NewRotation(path string) (*Rotation, error) {
+	r := &Rotation{
+		path:        path,
+		state:       RotationState{Singers: []*Singer{}, Round: 1, MaxPerRound: 1},
+		subscribers: make(map[chan *RotationState]bool),
+	}
+	if path == "" {
+		return r, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &r.state); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	r.state.Upcoming = nil
+	return r, nil
+}
+
+// State returns a copy of the rotation, with the next entries worked out.
+func (r *Rotation) State() *RotationState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.snapshot()
+}
+
+// Subscribe returns a channel that receives the state of the rotation, first
+// as it is and then after every change, and a function that closes it. Only
+// the latest state is kept for a subscriber that falls behind.
+func (r *Rotation) Subscribe() (states <-chan *RotationState, cancel func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	channel := make(chan *RotationState, 1)
+	channel <- r.snapshot()
+	r.subscribers[channel] = true
+
+	return channel, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.subscribers[channel] {
+			delete(r.subscribers, channel)
+			close(channel)
+		}
+	}
+}
+
+// AddSinger adds a singer to the rotation, at the end of the current round so
+// they don't jump ahead of anyone already waiting.
+func (r *Rotation) AddSinger(name string) (*Singer, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("a singer needs a name")
+	}
+	singer := &Singer{ID: newRotationID(), Name: name, Present: true, Requests: []*SongRequest{}}
+	err := r.change(func(state *RotationState) error {
+		// Just before whoever is up is last in line, which is the end of the
+		// list if the first singer is up.
+		if state.Up == 0 {
+			state.Singers = append(state.Singers, singer)
+			return nil
+		}
+		state.Singers = append(state.Singers[:state.Up], append([]*Singer{singer}, state.Singers[state.Up:]...)...)
+		state.Up++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	copied := *singer
+	return &copied, nil
+}
+
+// RemoveSinger takes a singer, and their requests, out of the rotation.
+func (r *Rotation) RemoveSinger(id string) error {
+	return r.change(func(state *RotationState) error {
+		at := state.find(id)
+		if at < 0 {
+			return ErrNotInRotation
+		}
+		state.Singers = append(state.Singers[:at], state.Singers[at+1:]...)
+		switch {
+		case at < state.Up:
+			state.Up--
+		case at == state.Up:
+			state.TurnSongs = 0
+		}
+		if state.Up >= len(state.Singers) {
+			state.Up = 0
+		}
+		return nil
+	})
+}
+
+// SetPresent marks a singer as here or not. Absent singers keep their place
+// and requests, but are skipped.
+func (r *Rotation) SetPresent(id string, present bool) error {
+	return r.change(func(state *RotationState) error {
+		at := state.find(id)
+		if at < 0 {
+			return ErrNotInRotation
+		}
+		state.Singers[at].Present = present
+		return nil
+	})
+}
+
+// AddRequest adds a song to the end of a singer's requests.
+func (r *Rotation) AddRequest(singer_id, song_id, title string) (*SongRequest, error) {
+	request := &SongRequest{ID: newRotationID(), SongID: song_id, Title: title, Added: time.Now().UTC()}
+	err := r.change(func(state *RotationState) error {
+		at := state.find(singer_id)
+		if at < 0 {
+			return ErrNotInRotation
+		}
+		state.Singers[at].Requests = append(state.Singers[at].Requests, request)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	copied := *request
+	return &copied, nil
+}
+
+// RemoveRequest takes a request off whichever singer made it.
+func (r *Rotation) RemoveRequest(id string) error {
+	return r.change(func(state *RotationState) error {
+		for _, singer := range state.Singers {
+			for idx, request := range singer.Requests {
+				if request.ID == id {
+					singer.Requests = append(singer.Requests[:idx], singer.Requests[idx+1:]...)
+					return nil
+				}
+			}
+		}
+		return ErrNotInRotation
+	})
+}
+
+// Reorder puts the singers in a new rotation order, which must name every
+// singer once. The singer who is up stays up.
+func (r *Rotation) Reorder(ids []string) error {
+	return r.change(func(state *RotationState) error {
+		if len(ids) != len(state.Singers) {
+			return fmt.Errorf("the new order has %d singers, the rotation %d", len(ids), len(state.Singers))
+		}
+		var up *Singer
+		if len(state.Singers) > 0 {
+			up = state.Singers[state.Up]
+		}
+		order := make([]*Singer, 0, len(ids))
+		seen := make(map[string]bool)
+		for _, id := range ids {
+			at := state.find(id)
+			if at < 0 || seen[id] {
+				return fmt.Errorf("the new order must name every singer once")
+			}
+			seen[id] = true
+			order = append(order, state.Singers[at])
+		}
+		state.Singers = order
+		if up != nil {
+			state.Up = state.find(up.ID)
+		}
+		return nil
+	})
+}
+
+// Bump moves a singer to sing next, straight after the singer who is up.
+func (r *Rotation) Bump(id string) error {
+	return r.change(func(state *RotationState) error {
+		at := state.find(id)
+		if at < 0 {
+			return ErrNotInRotation
+		}
+		if at == state.Up {
+			return nil
+		}
+		singer := state.Singers[at]
+		state.Singers = append(state.Singers[:at], state.Singers[at+1:]...)
+		if at < state.Up {
+			state.Up--
+		}
+		// Straight after whoever is up, or in their place if they are done.
+		next := state.Up + 1
+		if state.Current == nil || state.Current.SingerID != state.Singers[state.Up].ID {
+			next, state.TurnSongs = state.Up, 0
+		}
+		state.Singers = append(state.Singers[:next], append([]*Singer{singer}, state.Singers[next:]...)...)
+		return nil
+	})
+}
+
+// SetMaxPerRound sets how many songs each singer may sing in a row on their turn.
+func (r *Rotation) SetMaxPerRound(max int) error {
+	if max < 1 {
+		return fmt.Errorf("singers must be allowed at least one song a round")
+	}
+	return r.change(func(state *RotationState) error {
+		state.MaxPerRound = max
+		return nil
+	})
+}
+
+// Advance moves the rotation on to the next singer and song, taking the song
+// off their requests, and returns it. Once there is nobody left to sing it
+// returns nil, and nobody is singing.
+func (r *Rotation) Advance() (*RotationEntry, error) {
+	var entry *RotationEntry
+	err := r.change(func(state *RotationState) error {
+		up, turn_songs, round := state.Up, state.TurnSongs, state.Round
+		entry = state.next()
+		if entry == nil {
+			state.Up, state.TurnSongs, state.Round = up, turn_songs, round
+			state.Current = nil
+			return nil
+		}
+		state.Singers[state.Up].Sung++
+		state.Current = entry
+		return nil
+	})
+	return entry, err
+}
+
+// find returns the index of the singer with id, or -1.
+func (s *RotationState) find(id string) int {
+	for idx, singer := range s.Singers {
+		if singer.ID == id {
+			return idx
+		}
+	}
+	return -1
+}
+
+// next takes the next entry off the rotation, moving Up along, or returns nil
+// if nobody present has anything to sing.
+func (s *RotationState) next() *RotationEntry {
+	if len(s.Singers) == 0 {
+		return nil
+	}
+	for tries := 0; tries <= len(s.Singers); tries++ {
+		singer := s.Singers[s.Up]
+		if singer.Present && len(singer.Requests) > 0 && s.TurnSongs < s.MaxPerRound {
+			request := singer.Requests[0]
+			singer.Requests = singer.Requests[1:]
+			s.TurnSongs++
+			return &RotationEntry{SingerID: singer.ID, Name: singer.Name, Request: request, Round: s.Round}
+		}
+		s.Up, s.TurnSongs = s.Up+1, 0
+		if s.Up == len(s.Singers) {
+			s.Up = 0
+			s.Round++
+		}
+	}
+	return nil
+}
+
+// snapshot returns a deep copy of the state, with who sings next worked out
+// by running the rotation forward on another copy. r.mu must be held.
+func (r *Rotation) snapshot() *RotationState {
+	state := r.state.copy()
+	ahead := r.state.copy()
+	for entry := ahead.next(); entry != nil; entry = ahead.next() {
+		state.Upcoming = append(state.Upcoming, *entry)
+	}
+	return state
+}
+
+func (s *RotationState) copy() *RotationState {
+	copied := *s
+	copied.Upcoming = nil
+	copied.Singers = make([]*Singer, len(s.Singers))
+	for idx, singer := range s.Singers {
+		singer_copy := *singer
+		singer_copy.Requests = make([]*SongRequest, len(singer.Requests))
+		copy(singer_copy.Requests, singer.Requests)
+		copied.Singers[idx] = &singer_copy
+	}
+	return &copied
+}
+
+// change applies a change to the state, then saves it and sends it to the
+// subscribers. If the change fails, or can't be saved, the state is left as
+// it was.
+func (r *Rotation) change(apply func(state *RotationState) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state := r.state.copy()
+	if err := apply(state); err != nil {
+		return err
+	}
+	if r.path != "" {
+		data, err := json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ReplaceFile(r.path, append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	r.state = *state
+
+	snapshot := r.snapshot()
+	for channel := range r.subscribers {
+		// Replace a state the subscriber hasn't read yet with this one.
+		select {
+		case <-channel:
+		default:
+		}
+		channel <- snapshot
+	}
+	return nil
+}
+
+func newRotationID() string {
+	id := make([]byte, 6)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
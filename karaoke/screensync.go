@@ -0,0 +1,45 @@
+package karaoke
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SYNC_POSITION_INTERVAL is how often a server tells its screens where the song is.
+const SYNC_POSITION_INTERVAL = time.Second
+
+// A SyncMessage is one of the JSON text messages that keep a server's screens
+// in step, next to the frame messages of a TileBroadcaster. The server's
+// clock is the master. A screen sends a "ping" with the time on its own clock
+// and the server answers straight away with a "pong", adding the time on
+// its clock. Half the round trip gives the screen the offset between the
+// clocks, as NTP works it out, and with it the time on its own clock at which
+// to show each frame. The server also sends a "position" now and then, with
+// the song and where it is.
+type SyncMessage struct {
+	Type       string   `json:"type"`                  // "ping", "pong" or "position".
+	ClientTime float64  `json:"client_time,omitempty"` // When the ping was sent, on the screen's clock, echoed in the pong.
+	ServerTime float64  `json:"server_time,omitempty"` // When the pong or position was sent, see ServerTime.
+	Song       string   `json:"song,omitempty"`        // The song playing, for a position.
+	Position   Position `json:"position"`              // The pack shown at ServerTime, for a position.
+	Playing    bool     `json:"playing"`               // Whether the position is moving, for a position.
+}
+
+// ServerTime is t as the screens' clocks count it: milliseconds since 1970.
+func ServerTime(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Millisecond)
+}
+
+// AnswerPing returns the pong to a ping message from a screen.
+func AnswerPing(message []byte) ([]byte, error) {
+	received := ServerTime(time.Now())
+	var ping SyncMessage
+	if err := json.Unmarshal(message, &ping); err != nil {
+		return nil, err
+	}
+	if ping.Type != "ping" {
+		return nil, fmt.Errorf("expected a ping, got %q", ping.Type)
+	}
+	return json.Marshal(&SyncMessage{Type: "pong", ClientTime: ping.ClientTime, ServerTime: received})
+}
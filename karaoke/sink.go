@@ -0,0 +1,134 @@
+package karaoke
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// An AudioSink is where a Player sends the audio it plays. Open is called once,
+// before the first Write, with the format of the samples that will follow.
+// Write may block, the way a sound card does while its buffer is full; the
+// Player paces itself in realtime either way. Closing the sink is left to
+// whoever created it.
+type AudioSink interface {
+	Open(rate, channels int) error
+	Write(samples []float32) error
+	Close() error
+}
+
+// A NullSink throws the audio away, for playing without a sound card. The
+// Player's clock still advances with every sample written.
+type NullSink struct {
+	channels int
+	frames   int64
+}
+
+func NewNullSink() *NullSink {
+	return &NullSink{}
+}
+
+func (s *NullSink) Open(rate, channels int) error {
+	s.channels = channels
+	return nil
+}
+
+func (s *NullSink) Write(samples []float32) error {
+	s.frames += int64(len(samples) / s.channels)
+	return nil
+}
+
+func (s *NullSink) Close() error {
+	return nil
+}
+
+// Frames returns how many sample frames have been written.
+func (s *NullSink) Frames() int64 {
+	return s.frames
+}
+
+// A WAVSink records the audio to a 16 bit PCM .wav file, sample for sample as it
+// would have been played, so a recording can be lined up against the graphics
+// that were shown with it.
+type WAVSink struct {
+	w        io.WriteSeeker
+	rate     int
+	channels int
+	frames   int64
+	buf      []byte
+}
+
+// NewWAVSink returns a sink writing to w. The header is written by Open and
+// completed by Close, which also closes w if it is an io.Closer.
+func NewWAVSink(w io.WriteSeeker) *WAVSink {
+	return &WAVSink{w: w}
+}
+
+func (s *WAVSink) Open(rate, channels int) error {
+	s.rate, s.channels = rate, channels
+	return s.writeHeader()
+}
+
+// writeHeader writes the RIFF header for the samples written so far.
+func (s *WAVSink) writeHeader() error {
+	data_size := uint32(s.frames) * uint32(s.channels) * 2
+	header := make([]byte, 44)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], 36+data_size)
+	copy(header[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(header[22:], uint16(s.channels))
+	binary.LittleEndian.PutUint32(header[24:], uint32(s.rate))
+	binary.LittleEndian.PutUint32(header[28:], uint32(s.rate*s.channels*2))
+	binary.LittleEndian.PutUint16(header[32:], uint16(s.channels*2))
+	binary.LittleEndian.PutUint16(header[34:], 16)
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], data_size)
+	_, err := s.w.Write(header)
+	return err
+}
+
+func (s *WAVSink) Write(samples []float32) error {
+	if cap(s.buf) < len(samples)*2 {
+		s.buf = make([]byte, len(samples)*2)
+	}
+	buf := s.buf[:len(samples)*2]
+	for i, sample := range samples {
+		binary.LittleEndian.PutUint16(buf[i*2:], uint16(floatToInt16(sample)))
+	}
+	if _, err := s.w.Write(buf); err != nil {
+		return err
+	}
+	s.frames += int64(len(samples) / s.channels)
+	return nil
+}
+
+// Close fills in the sizes in the header now that they are known.
+func (s *WAVSink) Close() error {
+	_, err := s.w.Seek(0, io.SeekStart)
+	if err == nil {
+		err = s.writeHeader()
+	}
+	if closer, ok := s.w.(io.Closer); ok {
+		if close_err := closer.Close(); err == nil {
+			err = close_err
+		}
+	}
+	return err
+}
+
+// Frames returns how many sample frames have been written.
+func (s *WAVSink) Frames() int64 {
+	return s.frames
+}
+
+// floatToInt16 converts a sample to 16 bits, clipping anything out of range.
+func floatToInt16(sample float32) int16 {
+	switch {
+	case sample >= 1:
+		return 32767
+	case sample <= -1:
+		return -32768
+	}
+	return int16(sample * 32767)
+}
@@ -0,0 +1,219 @@
+package karaoke
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// AUDIO_EXTENSIONS are the audio formats a .cdg is paired with, in order of
+// preference when more than one sits next to it.
+var AUDIO_EXTENSIONS = []string{".mp3", ".ogg", ".wav"}
+
+// A Song is the graphics of a karaoke track together with its audio, so the
+// two always travel together. Songs are usually MP3+G: a .cdg next to an .mp3
+// with the same base name, or both zipped up in one archive.
+type Song struct {
+	Name        string   `json:"name"`         // Base name shared by the graphics and the audio.
+	Path        string   `json:"path"`         // The .cdg or .zip the song was loaded from.
+	CDG         []byte   `json:"-"`            // The subcode packs.
+	AudioPath   string   `json:"audio"`        // The audio file or zip entry, empty if there is none.
+	AudioFormat string   `json:"audio_format"` // "mp3", "ogg" or "wav".
+	Audio       []byte   `json:"-"`            // The encoded audio stream.
+	Meta        SongMeta `json:"meta"`         // What is remembered about the song, from MetaPath(Path).
+}
+
+// Length is how long the graphics of the song play for.
+func (s *Song) Length() Position {
+	return Position(len(s.CDG) / PACK_SIZE)
+}
+
+// SaveMeta writes s.Meta back to the metadata file next to the song.
+func (s *Song) SaveMeta() error {
+	return SaveSongMeta(s.Path, s.Meta)
+}
+
+// HasAudio reports whether an audio stream was found for the song.
+func (s *Song) HasAudio() bool {
+	return s.AudioPath != ""
+}
+
+func isAudioFile(name string) bool {
+	return audioRank(name) >= 0
+}
+
+// audioRank is the position of name's extension in AUDIO_EXTENSIONS, or -1.
+func audioRank(name string) int {
+	ext := filepath.Ext(name)
+	for i, audio_ext := range AUDIO_EXTENSIONS {
+		if strings.EqualFold(ext, audio_ext) {
+			return i
+		}
+	}
+	return -1
+}
+
+func audioFormat(name string) string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+}
+
+func baseName(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// LoadSong loads a song from a .cdg, from one of the audio files next to a .cdg,
+// or from an MP3+G .zip. The other half of the pair is looked up by base name,
+// ignoring the case of the extension. A .cdg without any audio still loads, with
+// HasAudio false, so it can be shown on its own.
+func LoadSong(name string) (*Song, error) {
+	return loadSong(name, true)
+}
+
+// loadSong loads a song, leaving out the audio itself unless with_audio is
+// set, for when only its graphics and where its audio is are needed.
+func loadSong(name string, with_audio bool) (*Song, error) {
+	switch {
+	case strings.EqualFold(filepath.Ext(name), ".zip"):
+		return loadSongZip(name, with_audio)
+	case isAudioFile(name):
+		cdg_name, err := findSibling(name, func(entry string) bool { return strings.EqualFold(filepath.Ext(entry), ".cdg") })
+		if err != nil {
+			return nil, err
+		}
+		if cdg_name == "" {
+			return nil, fmt.Errorf("%s: no .cdg file with the same name", name)
+		}
+		return loadSong(cdg_name, with_audio)
+	}
+
+	cdg_file_data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	song := &Song{Name: filepath.Base(baseName(name)), Path: name, CDG: cdg_file_data}
+	if song.Meta, err = LoadSongMeta(name); err != nil {
+		return nil, err
+	}
+
+	audio_name, err := FindAudio(name)
+	if err != nil || audio_name == "" {
+		return song, err
+	}
+	if with_audio {
+		if song.Audio, err = ioutil.ReadFile(audio_name); err != nil {
+			return nil, err
+		}
+	}
+	song.AudioPath, song.AudioFormat = audio_name, audioFormat(audio_name)
+	return song, nil
+}
+
+// FindAudio returns the audio file next to cdg_name with the same base name, or
+// "" if there is none.
+func FindAudio(cdg_name string) (string, error) {
+	return findSibling(cdg_name, isAudioFile)
+}
+
+// findSibling looks in the directory of name for another file with the same base
+// name that match accepts, preferring audio formats in AUDIO_EXTENSIONS order.
+func findSibling(name string, match func(string) bool) (string, error) {
+	dir, base := filepath.Split(baseName(name))
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	found := ""
+	for _, entry := range entries {
+		entry_name := entry.Name()
+		if entry.IsDir() || baseName(entry_name) != base || entry_name == filepath.Base(name) || !match(entry_name) {
+			continue
+		}
+		if found == "" || audioRank(entry_name) < audioRank(found) {
+			found = entry_name
+		}
+	}
+	if found == "" {
+		return "", nil
+	}
+	return filepath.Join(filepath.Dir(name), found), nil
+}
+
+// LoadSongZip loads an MP3+G archive. The archive must hold one .cdg; the audio
+// is the entry with the same base name or, failing that, the only audio entry.
+func LoadSongZip(name string) (*Song, error) {
+	return loadSongZip(name, true)
+}
+
+func loadSongZip(name string, with_audio bool) (*Song, error) {
+	archive, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	defer archive.Close()
+
+	var cdg_entry *zip.File
+	var audio_entries []*zip.File
+	for _, entry := range archive.File {
+		switch {
+		case entry.FileInfo().IsDir():
+		case strings.EqualFold(path.Ext(entry.Name), ".cdg"):
+			if cdg_entry != nil {
+				return nil, fmt.Errorf("%s: more than one .cdg in the archive", name)
+			}
+			cdg_entry = entry
+		case isAudioFile(entry.Name):
+			audio_entries = append(audio_entries, entry)
+		}
+	}
+	if cdg_entry == nil {
+		return nil, fmt.Errorf("%s: no .cdg in the archive", name)
+	}
+
+	song := &Song{Name: path.Base(baseName(cdg_entry.Name)), Path: name}
+	if song.Meta, err = LoadSongMeta(name); err != nil {
+		return nil, err
+	}
+	if song.CDG, err = readZipEntry(cdg_entry); err != nil {
+		return nil, fmt.Errorf("%s: %s: %v", name, cdg_entry.Name, err)
+	}
+
+	var audio_entry *zip.File
+	for _, entry := range audio_entries {
+		if baseName(entry.Name) != baseName(cdg_entry.Name) {
+			continue
+		}
+		if audio_entry == nil || audioRank(entry.Name) < audioRank(audio_entry.Name) {
+			audio_entry = entry
+		}
+	}
+	if audio_entry == nil && len(audio_entries) == 1 {
+		audio_entry = audio_entries[0]
+	}
+	if audio_entry == nil {
+		return song, nil
+	}
+
+	if with_audio {
+		if song.Audio, err = readZipEntry(audio_entry); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", name, audio_entry.Name, err)
+		}
+	}
+	song.AudioPath, song.AudioFormat = audio_entry.Name, audioFormat(audio_entry.Name)
+	return song, nil
+}
+
+func readZipEntry(entry *zip.File) ([]byte, error) {
+	reader, err := entry.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
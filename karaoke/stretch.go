@@ -0,0 +1,399 @@
+package karaoke
+
+import (
+	"io"
+	"math"
+)
+
+const (
+	stretch_window = 0.040 // Length of the windows overlapped by WSOLA, in seconds.
+	stretch_search = 0.012 // How far either side of the nominal position to look for the best fit, in seconds.
+)
+
+// stretcher changes the speed of a stream without changing its pitch, by WSOLA
+// (waveform similarity overlap-add): it cuts the input into Hann windows half a
+// window apart in the output, stepping through the input at speed times that,
+// and nudges each window to where it best continues the one before, so the
+// waveforms line up and the joins don't beat.
+type stretcher struct {
+	source   AudioStream
+	channels int
+	speed    float64 // Input frames consumed per output frame.
+	size     int     // Window length in frames.
+	hop      int     // Output frames per window, half the window.
+	search   int     // Frames either side of the nominal position searched.
+	window   []float32
+
+	in       []float32 // Input, interleaved, in[0] being input frame in_start.
+	in_start int64
+	in_eof   bool
+	in_end   int64 // The input frame the source ended at, once in_eof.
+
+	pos  float64   // Nominal input position of the next window.
+	prev int64     // Input position of the last window, -1 before the first.
+	tail []float32 // The windowed second half of the last window.
+	out  []float32 // Output ready to be read.
+	done bool
+	buf  []float32
+}
+
+func newStretcher(source AudioStream, speed float64) *stretcher {
+	rate, channels := source.SampleRate(), source.Channels()
+	s := &stretcher{
+		source:   source,
+		channels: channels,
+		speed:    speed,
+		hop:      int(float64(rate) * stretch_window / 2),
+		search:   int(float64(rate) * stretch_search),
+		buf:      make([]float32, 4096*channels),
+	}
+	s.size = s.hop * 2
+	s.window = make([]float32, s.size)
+	for i := range s.window {
+		s.window[i] = float32(0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(s.size)))
+	}
+	s.reset(0)
+	return s
+}
+
+func (s *stretcher) SampleRate() int { return s.source.SampleRate() }
+func (s *stretcher) Channels() int   { return s.channels }
+
+func (s *stretcher) Length() int64 {
+	length := s.source.Length()
+	if length < 0 {
+		return -1
+	}
+	return int64(float64(length) / s.speed)
+}
+
+// reset starts stretching afresh from input frame at.
+func (s *stretcher) reset(at int64) {
+	s.in, s.in_start, s.in_eof = s.in[:0], at, false
+	s.pos, s.prev = float64(at), -1
+	s.tail = make([]float32, s.hop*s.channels)
+	s.out, s.done = s.out[:0], false
+}
+
+func (s *stretcher) SeekFrame(frame int64) error {
+	if frame < 0 {
+		frame = 0
+	}
+	at := int64(float64(frame) * s.speed)
+	if err := s.source.SeekFrame(at); err != nil {
+		return err
+	}
+	s.reset(at)
+	return nil
+}
+
+func (s *stretcher) Read(samples []float32) (int, error) {
+	for len(s.out) < len(samples) && !s.done {
+		if err := s.step(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(samples, s.out)
+	n -= n % s.channels
+	s.out = s.out[:copy(s.out, s.out[n:])]
+	if n == 0 && s.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// fill reads the source until the input reaches frame end, or the source ends.
+func (s *stretcher) fill(end int64) error {
+	for !s.in_eof && s.in_start+int64(len(s.in)/s.channels) < end {
+		n, err := s.source.Read(s.buf)
+		s.in = append(s.in, s.buf[:n]...)
+		if err == io.EOF {
+			s.in_eof = true
+			s.in_end = s.in_start + int64(len(s.in)/s.channels)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sample returns input sample channel of frame at, silence outside the input.
+func (s *stretcher) sample(at int64, channel int) float32 {
+	i := (at-s.in_start)*int64(s.channels) + int64(channel)
+	if i < 0 || i >= int64(len(s.in)) {
+		return 0
+	}
+	return s.in[i]
+}
+
+// step adds one window, hop frames, to the output.
+func (s *stretcher) step() error {
+	nominal := int64(s.pos)
+	if err := s.fill(nominal + int64(s.search+s.size)); err != nil {
+		return err
+	}
+	if s.in_eof && nominal >= s.in_end {
+		// Let the last window ring out and stop.
+		s.out = append(s.out, s.tail...)
+		s.done = true
+		return nil
+	}
+
+	at := nominal
+	if s.prev >= 0 {
+		at = s.bestFit(nominal)
+	}
+
+	for i := 0; i < s.hop; i++ {
+		for c := 0; c < s.channels; c++ {
+			value := s.sample(at+int64(i), c)
+			if s.prev >= 0 {
+				value = s.tail[i*s.channels+c] + value*s.window[i]
+			}
+			s.out = append(s.out, value)
+			s.tail[i*s.channels+c] = s.sample(at+int64(s.hop+i), c) * s.window[s.hop+i]
+		}
+	}
+	s.prev = at
+	s.pos += float64(s.hop) * s.speed
+
+	// Drop the input before both the next search and the natural continuation.
+	keep_from := int64(s.pos) - int64(s.search)
+	if natural := s.prev + int64(s.hop); natural < keep_from {
+		keep_from = natural
+	}
+	if drop := keep_from - s.in_start; drop > 0 {
+		if frames := int64(len(s.in) / s.channels); drop > frames {
+			drop = frames
+		}
+		s.in = s.in[:copy(s.in, s.in[drop*int64(s.channels):])]
+		s.in_start += drop
+	}
+	return nil
+}
+
+// bestFit returns the input position within search of nominal whose start
+// best matches the natural continuation of the last window, by correlating a
+// mono mix of every other frame.
+func (s *stretcher) bestFit(nominal int64) int64 {
+	natural := s.prev + int64(s.hop)
+	low, high := nominal-int64(s.search), nominal+int64(s.search)
+	if low < s.in_start {
+		low = s.in_start
+	}
+
+	reference := make([]float32, 0, s.hop/2)
+	for i := 0; i < s.hop; i += 2 {
+		reference = append(reference, s.mono(natural+int64(i)))
+	}
+
+	best, best_score := nominal, math.Inf(-1)
+	for at := low; at <= high; at++ {
+		var score, energy float64
+		for j, ref := range reference {
+			value := s.mono(at + int64(j*2))
+			score += float64(value * ref)
+			energy += float64(value * value)
+		}
+		if energy > 0 {
+			score /= math.Sqrt(energy)
+		}
+		if score > best_score {
+			best, best_score = at, score
+		}
+	}
+	return best
+}
+
+func (s *stretcher) mono(at int64) float32 {
+	i := (at - s.in_start) * int64(s.channels)
+	if i < 0 || i+int64(s.channels) > int64(len(s.in)) {
+		return 0
+	}
+	var sum float32
+	for _, value := range s.in[i : i+int64(s.channels)] {
+		sum += value
+	}
+	return sum
+}
+
+// resampler plays a stream speed times faster, pitch and all, by cubic
+// interpolation between its samples.
+type resampler struct {
+	source   AudioStream
+	channels int
+	speed    float64
+
+	in       []float32 // Input, interleaved, in[0] being input frame in_start.
+	in_start int64
+	in_eof   bool
+	pos      float64 // Input position of the next output frame.
+	buf      []float32
+}
+
+func newResampler(source AudioStream, speed float64) *resampler {
+	return &resampler{
+		source:   source,
+		channels: source.Channels(),
+		speed:    speed,
+		buf:      make([]float32, 4096*source.Channels()),
+	}
+}
+
+func (r *resampler) SampleRate() int { return r.source.SampleRate() }
+func (r *resampler) Channels() int   { return r.channels }
+
+func (r *resampler) Length() int64 {
+	length := r.source.Length()
+	if length < 0 {
+		return -1
+	}
+	return int64(float64(length) / r.speed)
+}
+
+func (r *resampler) SeekFrame(frame int64) error {
+	if frame < 0 {
+		frame = 0
+	}
+	at := int64(float64(frame) * r.speed)
+	if err := r.source.SeekFrame(at); err != nil {
+		return err
+	}
+	r.in, r.in_start, r.in_eof = r.in[:0], at, false
+	r.pos = float64(at)
+	return nil
+}
+
+func (r *resampler) sample(at int64, channel int) float32 {
+	i := (at-r.in_start)*int64(r.channels) + int64(channel)
+	if i < 0 || i >= int64(len(r.in)) {
+		return 0
+	}
+	return r.in[i]
+}
+
+func (r *resampler) Read(samples []float32) (int, error) {
+	frames := len(samples) / r.channels
+	last := int64(r.pos+float64(frames)*r.speed) + 3
+
+	for !r.in_eof && r.in_start+int64(len(r.in)/r.channels) < last {
+		n, err := r.source.Read(r.buf)
+		r.in = append(r.in, r.buf[:n]...)
+		if err == io.EOF {
+			r.in_eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	in_end := r.in_start + int64(len(r.in)/r.channels)
+
+	n := 0
+	for ; n < frames; n++ {
+		at := int64(r.pos)
+		if r.in_eof && at >= in_end {
+			break
+		}
+		t := float32(r.pos - float64(at))
+		for c := 0; c < r.channels; c++ {
+			// Catmull-Rom through the four samples around the position.
+			p0, p1 := r.sample(at-1, c), r.sample(at, c)
+			p2, p3 := r.sample(at+1, c), r.sample(at+2, c)
+			samples[n*r.channels+c] = p1 + 0.5*t*(p2-p0+t*(2*p0-5*p1+4*p2-p3+t*(3*(p1-p2)+p3-p0)))
+		}
+		r.pos += r.speed
+	}
+
+	// Keep one frame before the position for the interpolation.
+	if keep := int64(r.pos) - 1 - r.in_start; keep > 0 {
+		if frames := int64(len(r.in) / r.channels); keep > frames {
+			keep = frames
+		}
+		r.in = r.in[:copy(r.in, r.in[keep*int64(r.channels):])]
+		r.in_start += keep
+	}
+
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n * r.channels, nil
+}
+
+const (
+	MAX_PITCH_SHIFT = 6   // How many semitones NewPitchShift moves the key either way.
+	MIN_TEMPO       = 0.5 // The slowest NewTempo plays a song.
+	MAX_TEMPO       = 2.0 // The fastest NewTempo plays a song.
+)
+
+// NewPitchShift changes the key of source by semitones, up to MAX_PITCH_SHIFT
+// either way, without changing its tempo: it is stretched to be longer or
+// shorter by the ratio between the keys, then played back faster or slower by
+// the same ratio. Sample frame n of the result is still sample frame n of the
+// source, so the graphics stay in sync.
+func NewPitchShift(source AudioStream, semitones float64) AudioStream {
+	semitones = math.Max(-MAX_PITCH_SHIFT, math.Min(MAX_PITCH_SHIFT, semitones))
+	if semitones == 0 {
+		return source
+	}
+	ratio := math.Pow(2, semitones/12)
+	return newTrimmed(newResampler(newStretcher(source, 1/ratio), ratio), source.Length())
+}
+
+// NewTempo plays source speed times as fast, between MIN_TEMPO and MAX_TEMPO,
+// without changing its pitch. Sample frame n of the result is sample frame
+// n*speed of the source; the graphics have to be sped up to match, which
+// Player.SetTempo does.
+func NewTempo(source AudioStream, speed float64) AudioStream {
+	speed = math.Max(MIN_TEMPO, math.Min(MAX_TEMPO, speed))
+	if speed == 1 {
+		return source
+	}
+	stretched := newStretcher(source, speed)
+	return newTrimmed(stretched, stretched.Length())
+}
+
+// trimmed stops a stream at a length, rather than letting the last window of
+// the stretcher ring out past the end of the source.
+type trimmed struct {
+	AudioStream
+	length int64
+	frame  int64
+}
+
+func newTrimmed(stream AudioStream, length int64) *trimmed {
+	return &trimmed{AudioStream: stream, length: length}
+}
+
+func (t *trimmed) Length() int64 {
+	return t.length
+}
+
+func (t *trimmed) Read(samples []float32) (int, error) {
+	channels := int64(t.Channels())
+	if t.length >= 0 {
+		left := (t.length - t.frame) * channels
+		if left <= 0 {
+			return 0, io.EOF
+		}
+		if int64(len(samples)) > left {
+			samples = samples[:left]
+		}
+		if len(samples) == 0 {
+			return 0, io.EOF
+		}
+	}
+	n, err := t.AudioStream.Read(samples)
+	t.frame += int64(n) / channels
+	return n, err
+}
+
+func (t *trimmed) SeekFrame(frame int64) error {
+	if frame < 0 {
+		frame = 0
+	}
+	// Past the end is the end, which Read then reports.
+	if t.length >= 0 && frame > t.length {
+		frame = t.length
+	}
+	t.frame = frame
+	return t.AudioStream.SeekFrame(frame)
+}
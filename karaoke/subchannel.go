@@ -0,0 +1,287 @@
+package karaoke
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	SUBCHANNEL_SIZE   = 96   // P-W subchannel bytes per sector.
+	AUDIO_SECTOR_SIZE = 2352 // Audio bytes per sector.
+	RAW_SECTOR_SIZE   = 2448 // Audio plus subchannel, as read with READ CD.
+	PACKS_PER_SECTOR  = 4    // 96 six bit R-W symbols make 4 packs.
+)
+
+// SubchannelLayout says how the eight P-W channels of a sector are arranged.
+type SubchannelLayout int
+
+const (
+	LayoutAuto        SubchannelLayout = iota // Detect from the Q channel CRCs.
+	LayoutInterleaved                         // One byte per symbol, P in bit 7 down to W in bit 0.
+	LayoutChannels                            // 12 bytes per channel, P first, as CloneCD writes .sub files.
+)
+
+var layout_names = []string{"auto", "interleaved", "clonecd"}
+
+func (l SubchannelLayout) String() string {
+	return layout_names[l]
+}
+
+// ParseSubchannelLayout parses "auto", "interleaved" or "clonecd".
+func ParseSubchannelLayout(name string) (SubchannelLayout, error) {
+	for idx, layout_name := range layout_names {
+		if layout_name == name {
+			return SubchannelLayout(idx), nil
+		}
+	}
+	return LayoutAuto, fmt.Errorf("unknown subchannel layout %q", name)
+}
+
+// SubchannelOptions control ConvertSubchannel.
+type SubchannelOptions struct {
+	SectorSize int              // SUBCHANNEL_SIZE for .sub files, RAW_SECTOR_SIZE for raw sectors.
+	Layout     SubchannelLayout // LayoutAuto unless the dump is known.
+	Track      int              // Only keep sectors of this track, or 0 for the whole dump.
+}
+
+// SubchannelStats describe what ConvertSubchannel found in a dump.
+type SubchannelStats struct {
+	Layout      SubchannelLayout `json:"layout"`
+	Sectors     int              `json:"sectors"`
+	Kept        int              `json:"kept_sectors"`
+	Packs       int              `json:"packs"`
+	QCRCErrors  int              `json:"q_crc_errors"`
+	Tracks      []int            `json:"tracks"`
+	Indexes     []QIndex         `json:"indexes"`
+	FirstSector int              `json:"first_sector"` // Of the kept range, or -1 if nothing was kept.
+}
+
+// A QIndex is where the Q channel first reports a track and index, such as the
+// pregap (index 0) or the start (index 1) of a song.
+type QIndex struct {
+	Track    int `json:"track"`
+	Index    int `json:"index"`
+	Sector   int `json:"sector"` // Counted from the start of the dump.
+	Absolute MSF `json:"absolute"`
+}
+
+// On disc the 24 symbols of a pack are spread over 8 packs: symbols 1/18, 2/5 and
+// 3/23 swap places, and the symbol that lands in position p is delayed p mod 8
+// packs. Symbol i of pack n is therefore stream symbol n*24 + offsets[i].
+var cdg_interleave_offsets = [PACK_SIZE]int{
+	0, 66, 125, 191, 100, 50, 150, 175,
+	8, 33, 58, 83, 108, 133, 158, 183,
+	16, 41, 25, 91, 116, 141, 166, 75,
+}
+
+// The interleave reaches this many symbols ahead of the start of a pack.
+const interleave_span = 8 * PACK_SIZE
+
+// deinterleaver turns the R-W symbol stream back into the flat packs of a .cdg.
+type deinterleaver struct {
+	symbols []byte
+	w       io.Writer
+	packs   int
+}
+
+func (di *deinterleaver) write(symbols []byte) error {
+	di.symbols = append(di.symbols, symbols...)
+	for len(di.symbols) >= interleave_span {
+		if err := di.emit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (di *deinterleaver) emit() error {
+	var cdg_pack [PACK_SIZE]byte
+	for idx, offset := range cdg_interleave_offsets {
+		cdg_pack[idx] = di.symbols[offset]
+	}
+	di.symbols = di.symbols[PACK_SIZE:]
+	di.packs++
+	_, err := di.w.Write(cdg_pack[:])
+	return err
+}
+
+// flush writes the packs still buffered, whose tails ran off the end of the
+// stream, padding them with zero symbols.
+func (di *deinterleaver) flush() error {
+	remaining := len(di.symbols) / PACK_SIZE
+	di.symbols = append(di.symbols, make([]byte, interleave_span)...)
+	for ; remaining > 0; remaining-- {
+		if err := di.emit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A QFrame is the Q channel of one sector. Only mode 1 (ADR 1) frames, which
+// carry the track, index and time, are decoded, the rest just keep their raw bytes.
+type QFrame struct {
+	Raw      [12]byte
+	Control  byte // Bit 2 is set for data tracks.
+	ADR      byte // 1 for position frames.
+	Track    int  // Track number, 0 in the lead-in, 0xAA in the lead-out.
+	Index    int  // Index within the track, 0 for the pregap.
+	Relative MSF  // Time within the track, counting down through the pregap.
+	Absolute MSF  // Time on the disc, see MSF.LBA.
+	Valid    bool // The CRC matched.
+}
+
+func fromBCD(b byte) int {
+	return int(b>>4)*10 + int(b&0x0F)
+}
+
+// qCRC is the CRC-16 (x^16 + x^12 + x^5 + 1) over the first 10 bytes of a Q
+// frame. It is stored inverted in the last two bytes.
+func qCRC(q []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range q[0:10] {
+		crc ^= uint16(b) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = (crc << 1) ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return ^crc
+}
+
+// ParseQFrame decodes the 12 bytes of a Q channel.
+func ParseQFrame(q []byte) QFrame {
+	var frame QFrame
+	copy(frame.Raw[:], q)
+	frame.Control = q[0] >> 4
+	frame.ADR = q[0] & 0x0F
+	frame.Valid = qCRC(q) == uint16(q[10])<<8|uint16(q[11])
+	if frame.ADR == 1 {
+		if q[1] == 0xAA {
+			frame.Track = 0xAA
+		} else {
+			frame.Track = fromBCD(q[1])
+		}
+		frame.Index = fromBCD(q[2])
+		frame.Relative = MSF{fromBCD(q[3]), fromBCD(q[4]), fromBCD(q[5])}
+		frame.Absolute = MSF{fromBCD(q[7]), fromBCD(q[8]), fromBCD(q[9])}
+	}
+	return frame
+}
+
+// splitSubchannel separates the 96 subchannel bytes of a sector into the R-W
+// symbols and the 12 bytes of the Q channel.
+func splitSubchannel(sub []byte, layout SubchannelLayout) (symbols [SUBCHANNEL_SIZE]byte, q [12]byte) {
+	if layout == LayoutChannels {
+		// Channel c occupies bytes 12*c to 12*c+11, one bit per symbol, MSB first.
+		for k := 0; k < SUBCHANNEL_SIZE; k++ {
+			byte_idx, bit := k/8, uint(7-k%8)
+			symbol := byte(0)
+			for channel := 2; channel < 8; channel++ {
+				symbol = symbol<<1 | (sub[channel*12+byte_idx]>>bit)&0x01
+			}
+			symbols[k] = symbol
+		}
+		copy(q[:], sub[12:24])
+		return symbols, q
+	}
+
+	for k := 0; k < SUBCHANNEL_SIZE; k++ {
+		symbols[k] = sub[k] & 0x3F
+		q[k/8] |= ((sub[k] >> 6) & 0x01) << uint(7-k%8)
+	}
+	return symbols, q
+}
+
+// DetectSubchannelLayout guesses the layout of a dump from a sample of its
+// sectors, by checking which layout gives Q frames with valid CRCs.
+func DetectSubchannelLayout(sample []byte, sector_size int) SubchannelLayout {
+	valid := map[SubchannelLayout]int{}
+	for offset := 0; offset+sector_size <= len(sample); offset += sector_size {
+		sub := sample[offset+sector_size-SUBCHANNEL_SIZE : offset+sector_size]
+		for _, layout := range []SubchannelLayout{LayoutInterleaved, LayoutChannels} {
+			if _, q := splitSubchannel(sub, layout); ParseQFrame(q[:]).Valid {
+				valid[layout]++
+			}
+		}
+	}
+	if valid[LayoutChannels] > valid[LayoutInterleaved] {
+		return LayoutChannels
+	}
+	return LayoutInterleaved
+}
+
+// ConvertSubchannel reads a raw subchannel dump from r, de-interleaves the R-W
+// channels according to the CD+G scheme and writes the flat 24 byte packs that
+// DecodePacks expects to w. The P and Q channels are dropped, except that with
+// opts.Track set the Q channel picks out the sectors of that track.
+func ConvertSubchannel(r io.Reader, w io.Writer, opts SubchannelOptions) (*SubchannelStats, error) {
+	sector_size := opts.SectorSize
+	if sector_size == 0 {
+		sector_size = SUBCHANNEL_SIZE
+	}
+	if sector_size < SUBCHANNEL_SIZE {
+		return nil, fmt.Errorf("sector size %d is smaller than the %d subchannel bytes", sector_size, SUBCHANNEL_SIZE)
+	}
+
+	reader := bufio.NewReaderSize(r, sector_size*256)
+	stats := &SubchannelStats{Layout: opts.Layout, Tracks: []int{}, Indexes: []QIndex{}, FirstSector: -1}
+
+	if stats.Layout == LayoutAuto {
+		sample, err := reader.Peek(sector_size * 256)
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		stats.Layout = DetectSubchannelLayout(sample, sector_size)
+	}
+
+	output := bufio.NewWriter(w)
+	di := &deinterleaver{w: output}
+	sector := make([]byte, sector_size)
+	current_track, current_index := 0, -1
+
+	for {
+		if _, err := io.ReadFull(reader, sector); err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			return stats, errors.New("dump ends with a partial sector")
+		} else if err != nil {
+			return stats, err
+		}
+
+		symbols, q := splitSubchannel(sector[sector_size-SUBCHANNEL_SIZE:], stats.Layout)
+		frame := ParseQFrame(q[:])
+		if !frame.Valid {
+			stats.QCRCErrors++
+		} else if frame.ADR == 1 && (frame.Track != current_track || frame.Index != current_index) {
+			// Sectors with a damaged or non-position Q frame stay with the last track seen.
+			if frame.Track != current_track && frame.Track != 0 && frame.Track != 0xAA {
+				stats.Tracks = append(stats.Tracks, frame.Track)
+			}
+			current_track, current_index = frame.Track, frame.Index
+			stats.Indexes = append(stats.Indexes, QIndex{frame.Track, frame.Index, stats.Sectors, frame.Absolute})
+		}
+
+		if opts.Track == 0 || opts.Track == current_track {
+			if stats.FirstSector < 0 {
+				stats.FirstSector = stats.Sectors
+			}
+			stats.Kept++
+			if err := di.write(symbols[:]); err != nil {
+				return stats, err
+			}
+		}
+		stats.Sectors++
+	}
+
+	if err := di.flush(); err != nil {
+		return stats, err
+	}
+	stats.Packs = di.packs
+	return stats, output.Flush()
+}
@@ -0,0 +1,117 @@
+package karaoke
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"strings"
+)
+
+// ScoreFrame counts the distinct 6x12 tiles on the visible screen that aren't a
+// single flat color. Title cards and lyric pages score high, blank or faded
+// screens score zero.
+func (d *Decoder) ScoreFrame() int {
+	distinct := make(map[[FONT_HEIGHT]int]bool)
+
+	for y_blk := 1; y_blk <= 16; y_blk++ {
+		for x_blk := 1; x_blk <= 48; x_blk++ {
+			var tile [FONT_HEIGHT]int
+			vram_loc := (y_blk * NUM_X_FONTS * FONT_HEIGHT) + x_blk
+			first_rgb := d.palette[d.vram[vram_loc]&0x0F]
+			flat := true
+
+			for y_inc := 0; y_inc < FONT_HEIGHT; y_inc++ {
+				curr_line_indices := d.vram[vram_loc+y_inc*NUM_X_FONTS]
+				tile[y_inc] = curr_line_indices
+				for pxl := uint(0); pxl < FONT_WIDTH; pxl++ {
+					if d.palette[(curr_line_indices>>(pxl*4))&0x0F] != first_rgb {
+						flat = false
+					}
+				}
+			}
+
+			if !flat {
+				distinct[tile] = true
+			}
+		}
+	}
+	return len(distinct)
+}
+
+// PickThumbnail decodes cdg_file_data up to window and returns the position of
+// the most informative frame, sampling every step. Ties go to the earliest
+// frame, which is usually the title card.
+func PickThumbnail(cdg_file_data []byte, window, step Position) (best_pack Position, best_score int) {
+	if total_packs := Position(len(cdg_file_data) / PACK_SIZE); window > total_packs {
+		window = total_packs
+	}
+
+	decoder := NewDecoder()
+	for pack := step; pack <= window; pack += step {
+		decoder.DecodePacks(cdg_file_data, pack)
+		if score := decoder.ScoreFrame(); score > best_score {
+			best_pack, best_score = pack, score
+		}
+	}
+	return best_pack, best_score
+}
+
+// ScaleNearest resizes src to width x height without smoothing, which keeps the
+// blocky CD+G pixels crisp.
+func ScaleNearest(src *image.RGBA, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		src_y := bounds.Min.Y + y*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			src_x := bounds.Min.X + x*bounds.Dx()/width
+			src_off := src.PixOffset(src_x, src_y)
+			dst_off := dst.PixOffset(x, y)
+			copy(dst.Pix[dst_off:dst_off+4], src.Pix[src_off:src_off+4])
+		}
+	}
+	return dst
+}
+
+// WriteThumbnail renders the frame at playback_position and writes it to w as a
+// width x height PNG.
+func WriteThumbnail(w io.Writer, cdg_file_data []byte, playback_position Position, width, height int) error {
+	decoder := NewDecoder()
+	decoder.DecodePacks(cdg_file_data, playback_position)
+	frame := decoder.RenderScreen()
+
+	if width == VISIBLE_WIDTH && height == VISIBLE_HEIGHT {
+		return png.Encode(w, frame)
+	}
+	return png.Encode(w, ScaleNearest(frame, width, height))
+}
+
+// ParseSize parses WxH. Either side may be omitted to keep the 3:2 aspect ratio.
+func ParseSize(size string) (width, height int, err error) {
+	parts := strings.SplitN(size, "x", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("bad size %q, want WxH", size)
+	}
+	if parts[0] != "" {
+		if _, err = fmt.Sscan(parts[0], &width); err != nil {
+			return 0, 0, fmt.Errorf("bad width in size %q", size)
+		}
+	}
+	if parts[1] != "" {
+		if _, err = fmt.Sscan(parts[1], &height); err != nil {
+			return 0, 0, fmt.Errorf("bad height in size %q", size)
+		}
+	}
+
+	switch {
+	case width <= 0 && height <= 0:
+		return 0, 0, fmt.Errorf("bad size %q, want WxH", size)
+	case width <= 0:
+		width = height * VISIBLE_WIDTH / VISIBLE_HEIGHT
+	case height <= 0:
+		height = width * VISIBLE_HEIGHT / VISIBLE_WIDTH
+	}
+	return width, height, nil
+}
@@ -0,0 +1,196 @@
+package karaoke
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	TILE_FRAME_MESSAGE = 'F'                       // First byte of a frame message from a TileEncoder.
+	NUM_TILES          = NUM_X_FONTS * NUM_Y_FONTS // 6x12 tiles in VRAM.
+	TILE_CLIENT_BUFFER = 32                        // Messages a TileBroadcaster holds for a client that is falling behind.
+
+	tile_size = 2 + FONT_HEIGHT*3 // Bytes of one tile in a message.
+)
+
+// A TileEncoder turns the frames of a Decoder into compact messages for a
+// screen that has no decoder of its own. It remembers what it has sent, so
+// each message only carries what has changed: the 6x12 tiles of VRAM that
+// differ and, if any color does, the color table. A message is, in little
+// endian:
+//
+//	byte      'F', TILE_FRAME_MESSAGE
+//	uint32    the position, in packs
+//	float64   when the frame is shown on the server, see ServerTime
+//	byte      the palette index of the border
+//	byte      flags: 1 if the palette follows
+//	[16][3]   the palette, red, green and blue, if flagged
+//	uint16    the number of tiles
+//	tiles     each a byte x (0-49) and y (0-17), then 12 rows of 3 bytes
+//	          holding six 4 bit palette indices, the leftmost pixel in the
+//	          low nibble of the first byte
+//
+// The whole of VRAM is sent, offscreen tiles too; the screen shows the 288x192
+// from pixel (6, 12). A TileEncoder starts out as a freshly reset Decoder.
+type TileEncoder struct {
+	vram     []int
+	palette  []int
+	border   int
+	position Position
+	shown    float64
+}
+
+// NewTileEncoder returns a TileEncoder for a screen in the reset state.
+func NewTileEncoder() *TileEncoder {
+	return &TileEncoder{
+		vram:    make([]int, NUM_X_FONTS*VRAM_HEIGHT),
+		palette: make([]int, PALETTE_ENTRIES),
+	}
+}
+
+// Encode returns a message bringing the screen up to date with d, shown at
+// time shown, or nil if nothing on the screen has changed since the last
+// message.
+func (e *TileEncoder) Encode(position Position, shown time.Time, d *Decoder) []byte {
+	palette_changed := false
+	for idx, color := range d.Palette() {
+		if e.palette[idx] != color {
+			e.palette[idx], palette_changed = color, true
+		}
+	}
+	border_changed := e.border != d.BorderIndex()
+	e.border, e.position, e.shown = d.BorderIndex(), position, ServerTime(shown)
+
+	var tiles []int
+	vram := d.VRAM()
+	for tile := 0; tile < NUM_TILES; tile++ {
+		changed := false
+		for row := 0; row < FONT_HEIGHT; row++ {
+			at := tileRow(tile, row)
+			if e.vram[at] != vram[at] {
+				e.vram[at], changed = vram[at], true
+			}
+		}
+		if changed {
+			tiles = append(tiles, tile)
+		}
+	}
+
+	if !palette_changed && !border_changed && len(tiles) == 0 {
+		return nil
+	}
+	return e.message(palette_changed, tiles)
+}
+
+// Keyframe returns a message with everything on the screen, for a screen that
+// has only just connected.
+func (e *TileEncoder) Keyframe() []byte {
+	tiles := make([]int, NUM_TILES)
+	for tile := range tiles {
+		tiles[tile] = tile
+	}
+	return e.message(true, tiles)
+}
+
+// tileRow is the index in VRAM of row of tile.
+func tileRow(tile, row int) int {
+	return (tile/NUM_X_FONTS*FONT_HEIGHT+row)*NUM_X_FONTS + tile%NUM_X_FONTS
+}
+
+func (e *TileEncoder) message(with_palette bool, tiles []int) []byte {
+	message := make([]byte, 15, 15+PALETTE_ENTRIES*3+2+len(tiles)*tile_size)
+	message[0] = TILE_FRAME_MESSAGE
+	binary.LittleEndian.PutUint32(message[1:], uint32(e.position))
+	binary.LittleEndian.PutUint64(message[5:], math.Float64bits(e.shown))
+	message[13] = byte(e.border)
+	if with_palette {
+		message[14] = 1
+		for _, color := range e.palette {
+			message = append(message, byte(color>>16), byte(color>>8), byte(color))
+		}
+	}
+
+	message = append(message, byte(len(tiles)), byte(len(tiles)>>8))
+	for _, tile := range tiles {
+		message = append(message, byte(tile%NUM_X_FONTS), byte(tile/NUM_X_FONTS))
+		for row := 0; row < FONT_HEIGHT; row++ {
+			pixels := e.vram[tileRow(tile, row)]
+			message = append(message, byte(pixels), byte(pixels>>8), byte(pixels>>16))
+		}
+	}
+	return message
+}
+
+// A TileBroadcaster is a FrameSink that encodes each frame once, with a
+// TileEncoder, and passes the message on to every subscribed screen. Frames
+// are stamped with the time they are handed over, so screens that know the
+// server's clock can all show them at the same moment. A screen
+// that falls more than TILE_CLIENT_BUFFER messages behind misses them, and is
+// sent a keyframe in their place once it catches up.
+type TileBroadcaster struct {
+	mu      sync.Mutex
+	encoder *TileEncoder
+	clients map[*tileClient]bool
+}
+
+type tileClient struct {
+	messages chan []byte
+	stale    bool // Messages have been dropped, so the next one has to be a keyframe.
+}
+
+// NewTileBroadcaster returns a TileBroadcaster with no subscribers.
+func NewTileBroadcaster() *TileBroadcaster {
+	return &TileBroadcaster{
+		encoder: NewTileEncoder(),
+		clients: make(map[*tileClient]bool),
+	}
+}
+
+// Subscribe returns a channel of messages for a new screen, starting with a
+// keyframe, and a function to call once the screen has gone, which closes the
+// channel.
+func (b *TileBroadcaster) Subscribe() (messages <-chan []byte, cancel func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	client := &tileClient{messages: make(chan []byte, TILE_CLIENT_BUFFER)}
+	client.messages <- b.encoder.Keyframe()
+	b.clients[client] = true
+
+	return client.messages, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.clients[client] {
+			delete(b.clients, client)
+			close(client.messages)
+		}
+	}
+}
+
+func (b *TileBroadcaster) Frame(position Position, d *Decoder) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	message := b.encoder.Encode(position, time.Now(), d)
+	if message == nil {
+		return nil
+	}
+
+	var keyframe []byte
+	for client := range b.clients {
+		send := message
+		if client.stale {
+			if keyframe == nil {
+				keyframe = b.encoder.Keyframe()
+			}
+			send = keyframe
+		}
+		select {
+		case client.messages <- send:
+			client.stale = false
+		default:
+			client.stale = true
+		}
+	}
+	return nil
+}
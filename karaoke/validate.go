@@ -0,0 +1,244 @@
+package karaoke
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Severity grades how badly a ValidationIssue affects playback.
+type Severity int
+
+const (
+	SeverityInfo    Severity = iota // Unusual, but players cope with it.
+	SeverityWarning                 // Likely damage, the picture may be wrong.
+	SeverityError                   // Corrupt data, players may skip it or crash.
+)
+
+var severity_names = []string{"info", "warning", "error"}
+
+func (s Severity) String() string {
+	if s < 0 || int(s) >= len(severity_names) {
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+	return severity_names[s]
+}
+
+func (s Severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *Severity) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	parsed, err := ParseSeverity(name)
+	*s = parsed
+	return err
+}
+
+// ParseSeverity parses "info", "warning" or "error".
+func ParseSeverity(name string) (Severity, error) {
+	for idx, severity_name := range severity_names {
+		if severity_name == name {
+			return Severity(idx), nil
+		}
+	}
+	return SeverityInfo, fmt.Errorf("unknown severity %q", name)
+}
+
+// A ValidationIssue is a single problem found in a .cdg file. Pack is the index
+// of the offending pack, or -1 for problems with the file as a whole.
+type ValidationIssue struct {
+	Pack     Position `json:"pack"`
+	Severity Severity `json:"severity"`
+	Code     string   `json:"code"`
+	Message  string   `json:"message"`
+}
+
+// A ValidationReport lists every issue found in one .cdg file.
+type ValidationReport struct {
+	File     string            `json:"file"`
+	Size     int               `json:"size"`
+	Packs    int               `json:"packs"`
+	Errors   int               `json:"errors"`
+	Warnings int               `json:"warnings"`
+	Infos    int               `json:"infos"`
+	Issues   []ValidationIssue `json:"issues"`
+}
+
+func (r *ValidationReport) add(pack Position, severity Severity, code string, format string, args ...interface{}) {
+	r.Issues = append(r.Issues, ValidationIssue{pack, severity, code, fmt.Sprintf(format, args...)})
+	switch severity {
+	case SeverityError:
+		r.Errors++
+	case SeverityWarning:
+		r.Warnings++
+	default:
+		r.Infos++
+	}
+}
+
+var instruction_names = map[byte]string{
+	MEMORY_PRESET:   "MEMORY_PRESET",
+	BORDER_PRESET:   "BORDER_PRESET",
+	COPY_FONT:       "COPY_FONT",
+	SCROLL_PRESET:   "SCROLL_PRESET",
+	SCROLL_COPY:     "SCROLL_COPY",
+	SET_TRANSPARENT: "SET_TRANSPARENT",
+	LOAD_CLUT_LO:    "LOAD_CLUT_LO",
+	LOAD_CLUT_HI:    "LOAD_CLUT_HI",
+	XOR_FONT:        "XOR_FONT",
+}
+
+// InstructionName returns the name of a TV graphics instruction, such as "XOR_FONT".
+func InstructionName(instruction byte) string {
+	if name, ok := instruction_names[instruction]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02X", instruction)
+}
+
+// Subcode modes other than TV graphics that may legitimately appear in a dump.
+var other_mode_names = map[byte]string{
+	0x08: "LINE_GRAPHICS",
+	0x0A: "EXTENDED_TV_GRAPHICS",
+	0x38: "CD_TEXT",
+}
+
+// Validate checks cdg_file_data for anything that DecodePacks would trip over,
+// silently ignore, or that suggests the file was damaged on the way off the disc.
+func Validate(name string, cdg_file_data []byte) *ValidationReport {
+	report := &ValidationReport{
+		File:   name,
+		Size:   len(cdg_file_data),
+		Packs:  len(cdg_file_data) / PACK_SIZE,
+		Issues: []ValidationIssue{},
+	}
+
+	if report.Size == 0 {
+		report.add(-1, SeverityError, "empty-file", "file contains no packs")
+		return report
+	}
+	if trailing := report.Size % PACK_SIZE; trailing != 0 {
+		report.add(-1, SeverityError, "odd-length", "file length %d is not a multiple of %d, the last %d bytes are a partial pack", report.Size, PACK_SIZE, trailing)
+	}
+
+	seen_clut := false
+	seen_preset := false
+	warned_clut := false
+	warned_preset := false
+	parity_present := false
+	pq_issue := -1 // The one pq-bits issue, reported at the first pack and counting them all.
+	pq_packs := 0
+
+	for curr_pack := Position(0); curr_pack < Position(report.Packs); curr_pack++ {
+		start_offset := int(curr_pack) * PACK_SIZE
+		this_pack := cdg_file_data[start_offset : start_offset+PACK_SIZE]
+
+		for _, b := range this_pack {
+			if b&0xC0 != 0 {
+				// A rip that kept them has them in every pack, so they are
+				// reported once rather than burying everything else.
+				if pq_issue < 0 {
+					pq_issue = len(report.Issues)
+					report.add(curr_pack, SeverityWarning, "pq-bits", "")
+				}
+				pq_packs++
+				break
+			}
+		}
+
+		if packParityPresent(this_pack) {
+			parity_present = true
+			if !packQParityOK(this_pack) {
+				report.add(curr_pack, SeverityWarning, "q-parity", "Q parity check failed, command or instruction may be corrupt")
+			}
+			if !packPParityOK(this_pack) {
+				report.add(curr_pack, SeverityWarning, "p-parity", "P parity check failed, pack data may be corrupt")
+			}
+		}
+
+		curr_command := this_pack[0] & 0x3F
+		if curr_command != TV_GRAPHICS {
+			if curr_command == 0x00 {
+				continue
+			}
+			if mode, ok := other_mode_names[curr_command]; ok {
+				report.add(curr_pack, SeverityInfo, "unsupported-mode", "%s pack (mode 0x%02X) is not decoded", mode, curr_command)
+			} else {
+				report.add(curr_pack, SeverityWarning, "unknown-mode", "unknown subcode mode 0x%02X", curr_command)
+			}
+			continue
+		}
+
+		curr_instruction := this_pack[1] & 0x3F
+		switch curr_instruction {
+		case MEMORY_PRESET:
+			if color := this_pack[4] & 0x3F; color >= PALETTE_ENTRIES {
+				report.add(curr_pack, SeverityError, "color-out-of-range", "MEMORY_PRESET color index %d exceeds the %d entry palette", color, PALETTE_ENTRIES)
+			}
+			seen_preset = true
+
+		case BORDER_PRESET:
+			if color := this_pack[4] & 0x3F; color >= PALETTE_ENTRIES {
+				report.add(curr_pack, SeverityError, "color-out-of-range", "BORDER_PRESET color index %d exceeds the %d entry palette", color, PALETTE_ENTRIES)
+			}
+
+		case LOAD_CLUT_LO, LOAD_CLUT_HI:
+			seen_clut = true
+
+		case COPY_FONT, XOR_FONT:
+			x_location := this_pack[7] & 0x3F
+			y_location := this_pack[6] & 0x1F
+			if x_location > NUM_X_FONTS-1 || y_location > NUM_Y_FONTS-1 {
+				report.add(curr_pack, SeverityError, "font-out-of-range", "%s at x=%d y=%d is outside the %dx%d font grid", instruction_names[curr_instruction], x_location, y_location, NUM_X_FONTS, NUM_Y_FONTS)
+			}
+			if !seen_clut && !warned_clut {
+				report.add(curr_pack, SeverityWarning, "missing-clut", "%s before any LOAD_CLUT, colors depend on the previous song", instruction_names[curr_instruction])
+				warned_clut = true
+			}
+			if !seen_preset && !warned_preset {
+				report.add(curr_pack, SeverityWarning, "missing-preset", "%s before any MEMORY_PRESET, the screen is not cleared first", instruction_names[curr_instruction])
+				warned_preset = true
+			}
+
+		case SCROLL_PRESET, SCROLL_COPY:
+			if (this_pack[5]&0x30)>>4 == 0x03 || (this_pack[6]&0x30)>>4 == 0x03 {
+				report.add(curr_pack, SeverityWarning, "bad-scroll", "%s has an invalid scroll direction", instruction_names[curr_instruction])
+			}
+
+		case SET_TRANSPARENT:
+			report.add(curr_pack, SeverityInfo, "unsupported-instruction", "SET_TRANSPARENT is not implemented and is ignored")
+
+		default:
+			report.add(curr_pack, SeverityWarning, "unknown-instruction", "unknown TV graphics instruction 0x%02X is skipped", curr_instruction)
+		}
+	}
+
+	if pq_issue >= 0 {
+		report.Issues[pq_issue].Message = fmt.Sprintf("P/Q subcode bits are set in %d packs from this one on, they should be stripped from a .cdg file", pq_packs)
+	}
+	if !seen_clut {
+		report.add(-1, SeverityError, "missing-clut", "file never loads a color table")
+	}
+	if !seen_preset {
+		report.add(-1, SeverityWarning, "missing-preset", "file never clears the screen with MEMORY_PRESET")
+	}
+	if !parity_present {
+		report.add(-1, SeverityInfo, "no-parity", "P/Q parity symbols are zeroed, parity was not checked")
+	}
+
+	return report
+}
+
+// Filter drops every issue below min_severity. The counts are left as they are.
+func (r *ValidationReport) Filter(min_severity Severity) {
+	filtered := r.Issues[:0]
+	for _, issue := range r.Issues {
+		if issue.Severity >= min_severity {
+			filtered = append(filtered, issue)
+		}
+	}
+	r.Issues = filtered
+}
@@ -0,0 +1,89 @@
+package karaoke
+
+import (
+	"math"
+	"sync"
+)
+
+const (
+	VOCAL_BAND_LOW  = 120.0  // Hz below which the centre is kept, for the bass and kick drum.
+	VOCAL_BAND_HIGH = 6000.0 // Hz above which the centre is kept, for the cymbals.
+)
+
+// vocalReducer takes the voice out of a stereo mix by cancelling what is the
+// same in both channels, where a lead vocal is almost always mixed, but only
+// between VOCAL_BAND_LOW and VOCAL_BAND_HIGH so the bass and drums, which are
+// usually in the centre too, survive.
+type vocalReducer struct {
+	AudioStream
+	mu       sync.Mutex
+	strength float32
+	band     [2]biquad // High then low pass, on the mid channel.
+}
+
+// NewVocalReduction returns source with its centre channel cancelled between
+// VOCAL_BAND_LOW and VOCAL_BAND_HIGH, by strength from 0 (not at all) to 1
+// (as far as it goes). Only stereo can be split into mid and side, so any
+// other source is returned as it is.
+func NewVocalReduction(source AudioStream, strength float64) AudioStream {
+	if source.Channels() != 2 || strength <= 0 {
+		return source
+	}
+	return newVocalReducer(source, strength)
+}
+
+func newVocalReducer(source AudioStream, strength float64) *vocalReducer {
+	v := &vocalReducer{AudioStream: source}
+	v.setStrength(strength)
+	rate := float64(source.SampleRate())
+	v.band[0] = butterworth(VOCAL_BAND_LOW, rate, true)
+	v.band[1] = butterworth(math.Min(VOCAL_BAND_HIGH, rate*0.45), rate, false)
+	return v
+}
+
+// butterworth returns a second order Butterworth high or low pass filter.
+func butterworth(frequency, rate float64, high bool) biquad {
+	w := 2 * math.Pi * frequency / rate
+	alpha := math.Sin(w) / math.Sqrt2
+	cos := math.Cos(w)
+	a0 := 1 + alpha
+	f := biquad{a1: -2 * cos / a0, a2: (1 - alpha) / a0}
+	if high {
+		f.b0, f.b1, f.b2 = (1+cos)/2/a0, -(1+cos)/a0, (1+cos)/2/a0
+	} else {
+		f.b0, f.b1, f.b2 = (1-cos)/2/a0, (1-cos)/a0, (1-cos)/2/a0
+	}
+	return f
+}
+
+func (v *vocalReducer) setStrength(strength float64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.strength = float32(math.Max(0, math.Min(1, strength)))
+}
+
+func (v *vocalReducer) Read(samples []float32) (int, error) {
+	n, err := v.AudioStream.Read(samples)
+	v.mu.Lock()
+	strength := v.strength
+	v.mu.Unlock()
+
+	if v.Channels() != 2 {
+		return n, err
+	}
+	for i := 0; i+1 < n; i += 2 {
+		left, right := samples[i], samples[i+1]
+		mid, side := (left+right)/2, (left-right)/2
+		// Keep the band filters running at strength 0 so turning the
+		// reduction on doesn't click.
+		band := float32(v.band[1].filter(v.band[0].filter(float64(mid))))
+		mid -= strength * band
+		samples[i], samples[i+1] = mid+side, mid-side
+	}
+	return n, err
+}
+
+func (v *vocalReducer) SeekFrame(frame int64) error {
+	v.band[0].z1, v.band[0].z2, v.band[1].z1, v.band[1].z2 = 0, 0, 0, 0
+	return v.AudioStream.SeekFrame(frame)
+}
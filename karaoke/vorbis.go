@@ -0,0 +1,39 @@
+package karaoke
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/jfreymuth/oggvorbis"
+)
+
+// vorbisStream decodes Ogg Vorbis as an AudioStream. Vorbis decodes to float
+// samples and keeps granule positions in every page, so it needs no help to
+// seek exactly or to know its length.
+type vorbisStream struct {
+	*oggvorbis.Reader
+}
+
+// NewVorbisStream decodes an Ogg Vorbis file, the other format the HTML5 player
+// takes.
+func NewVorbisStream(data []byte) (AudioStream, error) {
+	reader, err := oggvorbis.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("ogg: %v", err)
+	}
+	return &vorbisStream{reader}, nil
+}
+
+func (s *vorbisStream) Length() int64 {
+	if length := s.Reader.Length(); length > 0 {
+		return length
+	}
+	return -1
+}
+
+func (s *vorbisStream) SeekFrame(frame int64) error {
+	if frame < 0 {
+		frame = 0
+	}
+	return s.SetPosition(frame)
+}
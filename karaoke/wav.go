@@ -0,0 +1,144 @@
+package karaoke
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	WAVE_FORMAT_PCM        = 0x0001
+	WAVE_FORMAT_IEEE_FLOAT = 0x0003
+	WAVE_FORMAT_EXTENSIBLE = 0xFFFE
+)
+
+// wavStream reads the samples of a .wav file straight out of its data chunk.
+type wavStream struct {
+	data     []byte // The data chunk, whole sample frames only.
+	format   int    // WAVE_FORMAT_PCM or WAVE_FORMAT_IEEE_FLOAT.
+	rate     int
+	channels int
+	width    int // Bytes per sample.
+	frame    int64
+}
+
+// NewWAVStream reads a RIFF .wav file of 8, 16, 24 or 32 bit integer PCM, or 32
+// or 64 bit float samples, including WAVE_FORMAT_EXTENSIBLE files of either.
+func NewWAVStream(data []byte) (AudioStream, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, fmt.Errorf("wav: not a RIFF WAVE file")
+	}
+
+	s := &wavStream{}
+	found_fmt := false
+	for chunk := data[12:]; len(chunk) >= 8; {
+		id, size := string(chunk[0:4]), int64(binary.LittleEndian.Uint32(chunk[4:8]))
+		body := chunk[8:]
+		if size > int64(len(body)) {
+			// Streamed files leave the size at 0 or ~0, and truncated files
+			// claim more than is there: take what there is.
+			size = int64(len(body))
+		}
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, fmt.Errorf("wav: fmt chunk too short")
+			}
+			s.format = int(binary.LittleEndian.Uint16(body[0:]))
+			s.channels = int(binary.LittleEndian.Uint16(body[2:]))
+			s.rate = int(binary.LittleEndian.Uint32(body[4:]))
+			s.width = int(binary.LittleEndian.Uint16(body[14:])+7) / 8
+			if s.format == WAVE_FORMAT_EXTENSIBLE && size >= 26 {
+				// The real format is the start of the sub-format GUID.
+				s.format = int(binary.LittleEndian.Uint16(body[24:]))
+			}
+			found_fmt = true
+
+		case "data":
+			if !found_fmt {
+				return nil, fmt.Errorf("wav: data chunk before the fmt chunk")
+			}
+			if err := s.check(); err != nil {
+				return nil, err
+			}
+			frame_size := int64(s.width * s.channels)
+			s.data = body[:size-size%frame_size]
+			return s, nil
+		}
+
+		size += size & 1 // Chunks are padded to an even length.
+		if size > int64(len(body)) {
+			break
+		}
+		chunk = body[size:]
+	}
+	return nil, fmt.Errorf("wav: no data chunk")
+}
+
+// check rejects formats the stream can't convert.
+func (s *wavStream) check() error {
+	if s.channels < 1 || s.rate < 1 {
+		return fmt.Errorf("wav: %d channels at %d Hz", s.channels, s.rate)
+	}
+	switch {
+	case s.format == WAVE_FORMAT_PCM && s.width >= 1 && s.width <= 4:
+	case s.format == WAVE_FORMAT_IEEE_FLOAT && (s.width == 4 || s.width == 8):
+	default:
+		return fmt.Errorf("wav: unsupported format 0x%04X with %d bit samples", s.format, s.width*8)
+	}
+	return nil
+}
+
+func (s *wavStream) SampleRate() int { return s.rate }
+func (s *wavStream) Channels() int   { return s.channels }
+
+func (s *wavStream) Length() int64 {
+	return int64(len(s.data) / (s.width * s.channels))
+}
+
+func (s *wavStream) Read(samples []float32) (int, error) {
+	frames := int64(len(samples) / s.channels)
+	if left := s.Length() - s.frame; frames > left {
+		frames = left
+	}
+	if frames <= 0 {
+		return 0, io.EOF
+	}
+
+	n := int(frames) * s.channels
+	raw := s.data[s.frame*int64(s.width*s.channels):]
+	for i := 0; i < n; i++ {
+		sample := raw[i*s.width : (i+1)*s.width]
+		switch {
+		case s.format == WAVE_FORMAT_IEEE_FLOAT && s.width == 4:
+			samples[i] = math.Float32frombits(binary.LittleEndian.Uint32(sample))
+		case s.format == WAVE_FORMAT_IEEE_FLOAT:
+			samples[i] = float32(math.Float64frombits(binary.LittleEndian.Uint64(sample)))
+		case s.width == 1:
+			// 8 bit samples are the only unsigned ones.
+			samples[i] = float32(int(sample[0])-128) / 128
+		default:
+			// Left align the sample in 32 bits to sign extend it.
+			var value int32
+			for b := 0; b < s.width; b++ {
+				value |= int32(sample[b]) << uint(8*(4-s.width+b))
+			}
+			samples[i] = float32(value) / (1 << 31)
+		}
+	}
+	s.frame += frames
+	return n, nil
+}
+
+func (s *wavStream) SeekFrame(frame int64) error {
+	if frame < 0 {
+		frame = 0
+	}
+	if length := s.Length(); frame > length {
+		frame = length
+	}
+	s.frame = frame
+	return nil
+}
@@ -0,0 +1,235 @@
+package karaoke
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WEBSOCKET_TEXT   = 0x1 // Opcode of a UTF-8 text message.
+	WEBSOCKET_BINARY = 0x2 // Opcode of a binary message.
+
+	websocket_continuation = 0x0
+	websocket_close        = 0x8
+	websocket_ping         = 0x9
+	websocket_pong         = 0xA
+	websocket_guid         = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	websocket_max_message  = 1 << 20          // Largest message a client may send, in bytes.
+	websocket_write_wait   = 10 * time.Second // How long a write may take before the client is given up on.
+)
+
+// A WebSocket is the server end of an RFC 6455 WebSocket connection, just
+// enough of one for the player to talk to browsers without any dependencies.
+// Messages can be written from any goroutine, but only one goroutine may read.
+type WebSocket struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	write_mu sync.Mutex
+}
+
+// UpgradeWebSocket answers a WebSocket handshake and takes over the
+// connection. If the request isn't a valid handshake, or comes from a page
+// served by another host, it replies with an error and returns it.
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocket, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || !headerHas(r.Header, "Connection", "upgrade") ||
+		!headerHas(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "expected a WebSocket handshake", http.StatusBadRequest)
+		return nil, fmt.Errorf("%s: not a WebSocket handshake", r.RemoteAddr)
+	}
+	if version := r.Header.Get("Sec-WebSocket-Version"); version != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("%s: unsupported WebSocket version %q", r.RemoteAddr, version)
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "WebSocket from another origin", http.StatusForbidden)
+		return nil, fmt.Errorf("%s: refused a WebSocket from origin %q", r.RemoteAddr, r.Header.Get("Origin"))
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't upgrade this connection", http.StatusInternalServerError)
+		return nil, fmt.Errorf("%s: the connection can't be hijacked", r.RemoteAddr)
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + websocket_guid))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(hash[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &WebSocket{conn: conn, reader: rw.Reader}, nil
+}
+
+// sameOrigin reports whether a handshake comes from a page of the host it was
+// sent to. Browsers always send the page's Origin with a WebSocket and let any
+// page open one to any host, so without this a page from anywhere, open on a
+// phone on the same network, could drive the player. Clients that aren't
+// browsers send no Origin and are let in.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(parsed.Host, r.Host)
+}
+
+// headerHas reports whether one of the comma separated values of a header is
+// value, ignoring case.
+func headerHas(header http.Header, name, value string) bool {
+	for _, line := range header[name] {
+		for _, token := range strings.Split(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RemoteAddr returns the address of the client.
+func (ws *WebSocket) RemoteAddr() string {
+	return ws.conn.RemoteAddr().String()
+}
+
+// ReadMessage returns the next text or binary message from the client, with
+// its opcode, answering pings along the way. It returns io.EOF once the client
+// closes the connection.
+func (ws *WebSocket) ReadMessage() (opcode int, message []byte, err error) {
+	for {
+		fin, frame_opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch frame_opcode {
+		case websocket_close:
+			ws.writeFrame(websocket_close, payload)
+			ws.conn.Close()
+			return 0, nil, io.EOF
+		case websocket_ping:
+			if err := ws.writeFrame(websocket_pong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case websocket_pong:
+			continue
+		case websocket_continuation:
+			if opcode == 0 {
+				return 0, nil, fmt.Errorf("websocket: continuation without a message")
+			}
+		case WEBSOCKET_TEXT, WEBSOCKET_BINARY:
+			if opcode != 0 {
+				return 0, nil, fmt.Errorf("websocket: new message before the last one finished")
+			}
+			opcode = frame_opcode
+		default:
+			return 0, nil, fmt.Errorf("websocket: unknown opcode %#x", frame_opcode)
+		}
+
+		if len(message)+len(payload) > websocket_max_message {
+			return 0, nil, fmt.Errorf("websocket: message longer than %d bytes", websocket_max_message)
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (ws *WebSocket) readFrame() (fin bool, opcode int, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode = header[0]&0x80 != 0, int(header[0]&0x0F)
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, fmt.Errorf("websocket: unmasked frame from the client")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if length > websocket_max_message {
+		return false, 0, nil, fmt.Errorf("websocket: frame longer than %d bytes", websocket_max_message)
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage sends message to the client as a single frame, opcode being
+// WEBSOCKET_TEXT or WEBSOCKET_BINARY.
+func (ws *WebSocket) WriteMessage(opcode int, message []byte) error {
+	return ws.writeFrame(opcode, message)
+}
+
+func (ws *WebSocket) writeFrame(opcode int, payload []byte) error {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | byte(opcode)
+	switch length := len(payload); {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xFFFF:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	ws.write_mu.Lock()
+	defer ws.write_mu.Unlock()
+	ws.conn.SetWriteDeadline(time.Now().Add(websocket_write_wait))
+	if _, err := ws.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := ws.conn.Write(payload)
+	return err
+}
+
+// Close tells the client the connection is closing and closes it.
+func (ws *WebSocket) Close() error {
+	ws.writeFrame(websocket_close, []byte{0x03, 0xE8}) // 1000, a normal closure.
+	return ws.conn.Close()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/deckarep/karaoke4go/karaoke"
+)
+
+// loudnessResult is what the loudness command found for one song.
+type loudnessResult struct {
+	Song     string            `json:"song"`
+	Loudness *karaoke.Loudness `json:"loudness"`
+	Gain     float64           `json:"gain_db"`
+	Measured bool              `json:"measured"` // False if the stored measurement was reused.
+}
+
+func runLoudness(args []string) error {
+	flags := flag.NewFlagSet("loudness", flag.ExitOnError)
+	force := flags.Bool("force", false, "measure songs again even if they have been measured")
+	target := flags.Float64("target", 0, "loudness to report the gain for, in LUFS (default: from the settings, or -18)")
+	as_json := flags.Bool("json", false, "write one JSON object per line instead of text")
+	batch := addBatchFlags(flags)
+	flags.Parse(args)
+
+	files, err := expandInputs(flags.Args(), ".cdg", ".zip")
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("loudness: no .cdg files given")
+	}
+	if *target == 0 {
+		settings, err := loadSettings()
+		if err != nil {
+			return fmt.Errorf("loudness: %v", err)
+		}
+		*target = settings.target()
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+
+	summary, err := runBatch(files, batch,
+		func(file string) (interface{}, error) {
+			song, err := karaoke.LoadSong(file)
+			if err != nil {
+				return nil, err
+			}
+			result := &loudnessResult{Song: song.Name, Loudness: song.Meta.Loudness}
+			if result.Loudness == nil || *force {
+				if !song.HasAudio() {
+					return nil, fmt.Errorf("no audio to measure")
+				}
+				stream, err := karaoke.OpenAudio(song)
+				if err != nil {
+					return nil, err
+				}
+				if result.Loudness, err = karaoke.MeasureLoudness(stream); err != nil {
+					return nil, err
+				}
+				song.Meta.Loudness = result.Loudness
+				if err := song.SaveMeta(); err != nil {
+					return nil, err
+				}
+				result.Measured = true
+			}
+			result.Gain = result.Loudness.Gain(*target)
+			return result, nil
+		},
+		func(file string, result interface{}) error {
+			if *as_json {
+				return encoder.Encode(result)
+			}
+			r := result.(*loudnessResult)
+			fmt.Printf("%s: %.2f LUFS, true peak %.2f dBTP, gain %+.2f dB\n", file, r.Loudness.Integrated, r.Loudness.TruePeak, r.Gain)
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	if summary.Failed > 0 {
+		return fmt.Errorf("loudness: %d of %d files failed", summary.Failed, len(files))
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/deckarep/karaoke4go/karaoke"
+)
+
+// The format of the silence played for songs without audio.
+const (
+	silence_rate     = 44100
+	silence_channels = 2
+)
+
+// How long the break music plays after the last song, without -break-length,
+// if there is no telling how long it is.
+const default_last_break = 30 * time.Second
+
+// openSink opens the audio output named on the command line: "null" to throw the
+// audio away, or a .wav file to record it to.
+func openSink(name string) (karaoke.AudioSink, error) {
+	if name == "null" {
+		return karaoke.NewNullSink(), nil
+	}
+	if strings.EqualFold(filepath.Ext(name), ".wav") {
+		out_file, err := os.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		return karaoke.NewWAVSink(out_file), nil
+	}
+	return nil, fmt.Errorf("unknown audio output %q, expected null or a .wav file", name)
+}
+
+// sinkOutput is the name the latency of an audio output is set under.
+func sinkOutput(name string) string {
+	if name == "null" {
+		return name
+	}
+	return "wav"
+}
+
+// openSongAudio opens the audio of song with the effects applied, or returns
+// nil if it has none that can be decoded.
+func openSongAudio(song *karaoke.Song, effects *audioOptions) karaoke.AudioStream {
+	if !song.HasAudio() {
+		return nil
+	}
+	stream, err := karaoke.OpenAudio(song)
+	if err != nil {
+		log.Printf("play: %v, playing silence instead", err)
+		return nil
+	}
+	return effects.shift(stream)
+}
+
+func runPlay(args []string) error {
+	flags := flag.NewFlagSet("play", flag.ExitOnError)
+	from := positionVar(flags, "from", 0, "start playing from this point in the first song")
+	fps := flags.Int("fps", karaoke.DEFAULT_FRAME_RATE, "frames per second to render")
+	audio_out := flags.String("audio", "null", "audio output: null, or a .wav file to record to")
+	tempo := flags.Float64("tempo", 1, "play at this speed, 0.5 to 2, without changing the key")
+	normalize := flags.Bool("normalize", true, "play each song at the target loudness, if its loudness has been measured")
+	target := flags.Float64("target", 0, "loudness to normalize to in LUFS (default: from the settings, or -18)")
+	crossfade := flags.Duration("crossfade", 0, "fade each song into the next over this long")
+	break_music := flags.String("break", "", "an .mp3, .ogg or .wav to play between songs")
+	break_length := flags.Duration("break-length", 0, "play the break music for this long between songs and after the last song (default: only after the last song, once through, then stop)")
+	quiet := flags.Bool("q", false, "don't report the position on stderr")
+	effects := addAudioFlags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return fmt.Errorf("play: expected one or more .cdg, audio or .zip files")
+	}
+	if err := effects.check(); err != nil {
+		return fmt.Errorf("play: %v", err)
+	}
+	if err := checkTempo(*tempo); err != nil {
+		return fmt.Errorf("play: %v", err)
+	}
+
+	songs := make([]*karaoke.Song, flags.NArg())
+	for i, name := range flags.Args() {
+		song, err := karaoke.LoadSong(name)
+		if err != nil {
+			return err
+		}
+		songs[i] = song
+	}
+	var break_stream karaoke.AudioStream
+	if *break_music != "" {
+		stream, err := karaoke.OpenAudioFile(*break_music)
+		if err != nil {
+			return fmt.Errorf("play: %v", err)
+		}
+		break_stream = stream
+	}
+
+	settings, err := loadSettings()
+	if err != nil {
+		return fmt.Errorf("play: %v", err)
+	}
+	if *target == 0 {
+		*target = settings.target()
+	}
+	gain := func(song *karaoke.Song) float64 {
+		if *normalize && song.Meta.Loudness != nil {
+			return song.Meta.Loudness.Gain(*target)
+		}
+		return 0
+	}
+
+	sink, err := openSink(*audio_out)
+	if err != nil {
+		return fmt.Errorf("play: %v", err)
+	}
+
+	first := songs[0]
+	stream := openSongAudio(first, effects)
+	if stream == nil {
+		stream = karaoke.NewSilence(silence_rate, silence_channels, karaoke.FramesOfPosition(first.Length(), silence_rate))
+	}
+	player := karaoke.NewPlayer(first.CDG, nil)
+	player.SetFrameRate(*fps)
+	player.SetTempo(*tempo)
+	player.SetVocalReduction(effects.vocalReduction(first))
+	player.SetOffset(first.Meta.Offset())
+	player.SetLatency(settings.latency(sinkOutput(*audio_out)), settings.latency("screen"))
+	player.SetGain(gain(first))
+	player.SetCrossfade(*crossfade)
+	if err := player.SetAudio(stream, sink); err != nil {
+		sink.Close()
+		return err
+	}
+	for _, song := range songs[1:] {
+		player.Enqueue(karaoke.Track{
+			Name:           song.Name,
+			CDG:            song.CDG,
+			Audio:          openSongAudio(song, effects),
+			Offset:         song.Meta.Offset(),
+			Gain:           gain(song),
+			VocalReduction: effects.vocalReduction(song),
+		})
+	}
+	if break_stream != nil {
+		player.SetBreakMusic(break_stream, *break_length)
+	}
+
+	frames := 0
+	player.AddSink(karaoke.FrameSinkFunc(func(position karaoke.Position, d *karaoke.Decoder) error {
+		frames++
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "\r\033[K%v", position)
+		}
+		return nil
+	}))
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		player.Stop()
+	}()
+	player.Seek(from.Position)
+	player.Play()
+	if break_stream != nil {
+		// The break music would play forever once the queue runs out, so
+		// after the last song it plays for the break length, or once through,
+		// and then playback stops.
+		last_break := *break_length
+		if last_break == 0 {
+			last_break = default_last_break
+			if frames := break_stream.Length(); frames > 0 {
+				last_break = time.Duration(frames) * time.Second / time.Duration(break_stream.SampleRate())
+			}
+		}
+		go func() {
+			var started time.Time
+			for player.State() != karaoke.PlayerStopped {
+				if !player.InBreak() || len(player.Queue()) > 0 {
+					started = time.Time{}
+				} else if started.IsZero() {
+					started = time.Now()
+				} else if time.Since(started) >= last_break {
+					player.Stop()
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}()
+	}
+	play_err := player.Wait()
+	if !*quiet {
+		fmt.Fprintln(os.Stderr)
+	}
+
+	if err := sink.Close(); err != nil && play_err == nil {
+		play_err = err
+	}
+	if play_err != nil {
+		return fmt.Errorf("play: %v", play_err)
+	}
+
+	name := first.Name
+	if len(songs) > 1 {
+		name = fmt.Sprintf("%d songs", len(songs))
+	}
+	switch sink := sink.(type) {
+	case *karaoke.WAVSink:
+		fmt.Printf("%s: %d frames, %d sample frames recorded to %s\n", name, frames, sink.Frames(), *audio_out)
+	case *karaoke.NullSink:
+		fmt.Printf("%s: %d frames, %d sample frames played\n", name, frames, sink.Frames())
+	}
+	return nil
+}
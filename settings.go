@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/deckarep/karaoke4go/karaoke"
+)
+
+// settings are the options that belong to the machine rather than to a song,
+// kept in karaoke4go/settings.json under the user's config directory.
+type settings struct {
+	// LatencyMs is how long each output takes to be heard or seen, by output
+	// name: "null" and "wav" for the audio outputs, "screen" for the display.
+	LatencyMs map[string]int `json:"latency_ms,omitempty"`
+
+	// TargetLUFS is the loudness songs are played at, 0 for the default.
+	TargetLUFS float64 `json:"target_lufs,omitempty"`
+}
+
+func settingsPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "karaoke4go", "settings.json"), nil
+}
+
+// loadSettings reads the settings file, or returns empty settings if there is
+// none yet.
+func loadSettings() (*settings, error) {
+	s := &settings{}
+	name, err := settingsPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return s, nil
+}
+
+func (s *settings) save() error {
+	name, err := settingsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return karaoke.ReplaceFile(name, append(data, '\n'))
+}
+
+// target returns the loudness songs are normalised to.
+func (s *settings) target() float64 {
+	if s.TargetLUFS == 0 {
+		return karaoke.DEFAULT_TARGET_LOUDNESS
+	}
+	return s.TargetLUFS
+}
+
+// latency returns the latency set for an output, 0 if none has been.
+func (s *settings) latency(output string) time.Duration {
+	return time.Duration(s.LatencyMs[output]) * time.Millisecond
+}
+
+func (s *settings) setLatency(output string, latency time.Duration) {
+	if s.LatencyMs == nil {
+		s.LatencyMs = make(map[string]int)
+	}
+	s.LatencyMs[output] = int(latency.Round(time.Millisecond) / time.Millisecond)
+}
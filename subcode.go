@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/deckarep/karaoke4go/karaoke"
+)
+
+func runSubcode(args []string) error {
+	flags := flag.NewFlagSet("subcode", flag.ExitOnError)
+	layout_name := flags.String("layout", "auto", "subchannel layout: auto, interleaved or clonecd")
+	sector_size := flags.Int("sector", 0, "bytes per sector: 96 or 2448 (default: 96 for .sub files, else 2448)")
+	track := flags.Int("track", 0, "only extract this track (default: the whole dump)")
+	out_name := flags.String("o", "", "output .cdg file (default: the dump name with a .cdg extension)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("subcode: expected exactly one subchannel dump")
+	}
+	dump_name := flags.Arg(0)
+
+	layout, err := karaoke.ParseSubchannelLayout(*layout_name)
+	if err != nil {
+		return fmt.Errorf("subcode: %v", err)
+	}
+
+	opts := karaoke.SubchannelOptions{SectorSize: *sector_size, Layout: layout, Track: *track}
+	if opts.SectorSize == 0 {
+		opts.SectorSize = karaoke.RAW_SECTOR_SIZE
+		if strings.EqualFold(filepath.Ext(dump_name), ".sub") {
+			opts.SectorSize = karaoke.SUBCHANNEL_SIZE
+		}
+	}
+
+	if *out_name == "" {
+		*out_name = strings.TrimSuffix(dump_name, filepath.Ext(dump_name)) + ".cdg"
+		if *track != 0 {
+			*out_name = strings.TrimSuffix(dump_name, filepath.Ext(dump_name)) + fmt.Sprintf("-track%02d.cdg", *track)
+		}
+	}
+
+	in_file, err := os.Open(dump_name)
+	if err != nil {
+		return err
+	}
+	defer in_file.Close()
+
+	out_file, err := os.Create(*out_name)
+	if err != nil {
+		return err
+	}
+	defer out_file.Close()
+
+	stats, err := karaoke.ConvertSubchannel(in_file, out_file, opts)
+	if err != nil {
+		return fmt.Errorf("subcode: %s: %v", dump_name, err)
+	}
+	if *track != 0 && stats.Kept == 0 {
+		return fmt.Errorf("subcode: %s: track %d not found, the dump has tracks %v", dump_name, *track, stats.Tracks)
+	}
+
+	fmt.Printf("%s: %d sectors, %s layout, tracks %v, %d Q CRC errors\n", dump_name, stats.Sectors, stats.Layout, stats.Tracks, stats.QCRCErrors)
+	for _, index := range stats.Indexes {
+		fmt.Printf("  track %2d index %2d  at sector %-7d absolute %v\n", index.Track, index.Index, index.Sector, index.Absolute)
+	}
+	fmt.Printf("%s: %d packs from %d sectors starting at sector %d\n", *out_name, stats.Packs, stats.Kept, stats.FirstSector)
+	return out_file.Close()
+}
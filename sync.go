@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/deckarep/karaoke4go/karaoke"
+)
+
+// output_names are the outputs a latency can be set for.
+var output_names = []string{"null", "wav", "screen"}
+
+// runSync shows and adjusts how songs and outputs are synchronised: the offset
+// of a song's graphics from its audio, saved next to the song, and the latency
+// of an output, saved in the settings.
+func runSync(args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	nudge := flags.Duration("nudge", 0, "move the graphics this much later, or earlier if negative, and save")
+	set := flags.Duration("set", 0, "set the offset, or with -output the latency, and save")
+	output := flags.String("output", "", "adjust the latency of this output (null, wav or screen) instead of a song")
+	flags.Parse(args)
+
+	set_given := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "set" {
+			set_given = true
+		}
+	})
+
+	if *output != "" {
+		return syncOutput(*output, *set, set_given, *nudge, flags.NArg())
+	}
+
+	if flags.NArg() == 0 {
+		return fmt.Errorf("sync: expected songs, or -output")
+	}
+	for _, name := range flags.Args() {
+		song, err := karaoke.LoadSong(name)
+		if err != nil {
+			return err
+		}
+		offset := song.Meta.Offset()
+		if set_given {
+			offset = *set
+		}
+		offset += *nudge
+		if set_given || *nudge != 0 {
+			song.Meta.SetOffset(offset)
+			if err := song.SaveMeta(); err != nil {
+				return fmt.Errorf("sync: %v", err)
+			}
+		}
+		fmt.Printf("%s: graphics offset %v\n", song.Name, song.Meta.Offset())
+	}
+	return nil
+}
+
+func syncOutput(output string, set time.Duration, set_given bool, nudge time.Duration, songs int) error {
+	known := false
+	for _, name := range output_names {
+		known = known || name == output
+	}
+	if !known {
+		return fmt.Errorf("sync: unknown output %q, expected null, wav or screen", output)
+	}
+	if songs != 0 {
+		return fmt.Errorf("sync: -output adjusts an output, not songs")
+	}
+
+	s, err := loadSettings()
+	if err != nil {
+		return fmt.Errorf("sync: %v", err)
+	}
+	latency := s.latency(output)
+	if set_given {
+		latency = set
+	}
+	latency += nudge
+	if set_given || nudge != 0 {
+		s.setLatency(output, latency)
+		if err := s.save(); err != nil {
+			return fmt.Errorf("sync: %v", err)
+		}
+	}
+	fmt.Printf("%s: latency %v\n", output, s.latency(output))
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/deckarep/karaoke4go/karaoke"
+)
+
+// thumbnailResult is what the thumbnail command records for each song.
+type thumbnailResult struct {
+	Pack   karaoke.Position `json:"pack"`
+	Time   float64          `json:"seconds"`
+	Score  int              `json:"distinct_tiles"`
+	Output string           `json:"output"`
+}
+
+func runThumbnail(args []string) error {
+	flags := flag.NewFlagSet("thumbnail", flag.ExitOnError)
+	within := positionVar(flags, "within", 30*karaoke.PACKS_PER_SECOND, "only consider frames up to this point in the song")
+	flags.Var(within, "seconds", "deprecated, the same as -within")
+	size := flags.String("size", "288x192", "size of the PNG as WxH, either side may be left out")
+	out_name := flags.String("o", "", "output PNG for a single song (default: the .cdg name with a .png extension)")
+	out_dir := flags.String("d", "", "write thumbnails into this directory instead of next to each song, keeping the directories they are in")
+	batch := addBatchFlags(flags)
+	flags.Parse(args)
+
+	width, height, err := karaoke.ParseSize(*size)
+	if err != nil {
+		return fmt.Errorf("thumbnail: %v", err)
+	}
+
+	files, err := expandInputs(flags.Args(), ".cdg")
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("thumbnail: no .cdg files given")
+	}
+	if *out_name != "" && len(files) > 1 {
+		return fmt.Errorf("thumbnail: -o only works with a single song, use -d for many")
+	}
+
+	// Songs keep their place under the directory all of them are in, so two
+	// songs with the same name in different directories don't collide.
+	var songs_dir string
+	if *out_dir != "" {
+		if songs_dir, err = commonDir(files); err != nil {
+			return fmt.Errorf("thumbnail: %v", err)
+		}
+	}
+
+	summary, err := runBatch(files, batch,
+		func(file string) (interface{}, error) {
+			cdg_file_data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+
+			best_pack, best_score := karaoke.PickThumbnail(cdg_file_data, within.Position, karaoke.PACKS_PER_SECOND/4)
+
+			output := *out_name
+			if output == "" {
+				output = strings.TrimSuffix(file, filepath.Ext(file)) + ".png"
+				if *out_dir != "" {
+					if output, err = placeUnder(*out_dir, songs_dir, output); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+				return nil, err
+			}
+
+			out_file, err := os.Create(output)
+			if err != nil {
+				return nil, err
+			}
+			if err := karaoke.WriteThumbnail(out_file, cdg_file_data, best_pack, width, height); err != nil {
+				out_file.Close()
+				return nil, err
+			}
+			if err := out_file.Close(); err != nil {
+				return nil, err
+			}
+
+			return &thumbnailResult{best_pack, best_pack.Seconds(), best_score, output}, nil
+		},
+		func(file string, result interface{}) error {
+			thumb := result.(*thumbnailResult)
+			fmt.Printf("%s: frame at %v (pack %d, %d distinct tiles) -> %s\n", file, thumb.Pack, thumb.Pack, thumb.Score, thumb.Output)
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	if summary.Failed > 0 {
+		return fmt.Errorf("thumbnail: %d of %d files failed", summary.Failed, len(files))
+	}
+	return nil
+}
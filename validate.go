@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/deckarep/karaoke4go/karaoke"
+)
+
+func printValidationReport(report *karaoke.ValidationReport) {
+	fmt.Printf("%s: %d packs, %d errors, %d warnings, %d infos\n", report.File, report.Packs, report.Errors, report.Warnings, report.Infos)
+	for _, issue := range report.Issues {
+		if issue.Pack < 0 {
+			fmt.Printf("  file                 [%s] %s: %s\n", issue.Severity, issue.Code, issue.Message)
+		} else {
+			fmt.Printf("  pack %-5d %9v [%s] %s: %s\n", issue.Pack, issue.Pack, issue.Severity, issue.Code, issue.Message)
+		}
+	}
+}
+
+func runValidate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	as_json := flags.Bool("json", false, "write one JSON report per line instead of text")
+	min_severity := flags.String("min", "info", "lowest severity to report: info, warning or error")
+	batch := addBatchFlags(flags)
+	flags.Parse(args)
+
+	threshold, err := karaoke.ParseSeverity(*min_severity)
+	if err != nil {
+		return fmt.Errorf("validate: %v", err)
+	}
+
+	files, err := expandInputs(flags.Args(), ".cdg")
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("validate: no .cdg files given")
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	failed := 0
+
+	summary, err := runBatch(files, batch,
+		func(file string) (interface{}, error) {
+			cdg_file_data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			report := karaoke.Validate(file, cdg_file_data)
+			report.Filter(threshold)
+			return report, nil
+		},
+		func(file string, result interface{}) error {
+			report := result.(*karaoke.ValidationReport)
+			if report.Errors > 0 {
+				failed++
+			}
+			if *as_json {
+				return encoder.Encode(report)
+			}
+			printValidationReport(report)
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	if failed > 0 || summary.Failed > 0 {
+		return fmt.Errorf("validate: %d of %d files have errors, %d could not be read", failed, len(files), summary.Failed)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/deckarep/karaoke4go/karaoke"
+)
+
+// runVocals shows or sets how strongly the vocals of songs are reduced when they
+// are played, cut or exported, for tracks that aren't karaoke mixes.
+func runVocals(args []string) error {
+	flags := flag.NewFlagSet("vocals", flag.ExitOnError)
+	set := flags.Float64("set", -1, "reduce the vocals by this much from now on, 0 (off) to 1, and save")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return fmt.Errorf("vocals: expected songs")
+	}
+	if *set > 1 {
+		return fmt.Errorf("vocals: -set must be between 0 and 1")
+	}
+	for _, name := range flags.Args() {
+		song, err := karaoke.LoadSong(name)
+		if err != nil {
+			return err
+		}
+		if *set >= 0 {
+			song.Meta.VocalReduction = *set
+			if err := song.SaveMeta(); err != nil {
+				return fmt.Errorf("vocals: %v", err)
+			}
+		}
+		fmt.Printf("%s: vocal reduction %v\n", song.Name, song.Meta.VocalReduction)
+	}
+	return nil
+}